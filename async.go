@@ -0,0 +1,21 @@
+package nbd
+
+// AsyncOp is an operation submitted to an AsyncBlockDevice.
+type AsyncOp = Op
+
+// AsyncBlockDevice can be implemented by a BlockDevice which performs I/O
+// asynchronously, such as with io_uring or a pipelined RPC client. Instead of
+// calling ReadAt and WriteAt from ConcurrentOps worker goroutines, the server
+// submits every request to the device as it is received, and the device
+// completes them in any order. ConcurrentOps is ignored.
+//
+// Flush and Trim requests are submitted only if the device also implements
+// BlockDeviceFlusher and BlockDeviceTrimer respectively.
+type AsyncBlockDevice interface {
+	BlockDevice
+
+	// Submit starts op, and must not block until it has completed. complete
+	// must be called exactly once when the operation finishes, from any
+	// goroutine. A successful read must fill all of op.Data.
+	Submit(op AsyncOp, complete func(err error))
+}
@@ -0,0 +1,118 @@
+package nbd
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// asyncDevice is an AsyncBlockDevice which holds submitted operations until
+// batch have been submitted, and then completes them in reverse order.
+type asyncDevice struct {
+	*memDevice
+	batch int
+
+	lock    sync.Mutex
+	pending []func()
+}
+
+func (d *asyncDevice) Submit(op AsyncOp, complete func(error)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.pending = append(d.pending, func() { complete(handleOp(d.memDevice, op)) })
+	if len(d.pending) < d.batch {
+		return
+	}
+	pending := d.pending
+	d.pending = nil
+	go func() {
+		for i := len(pending) - 1; i >= 0; i-- {
+			pending[i]()
+		}
+	}()
+}
+
+func TestAsyncCompletesOutOfOrder(t *testing.T) {
+	const n = 8
+	dev := &asyncDevice{memDevice: newMemDevice(1 << 20), batch: n}
+	for i := 0; i < n; i++ {
+		copy(dev.data[i*4096:], pattern(4096, byte(i)))
+	}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+
+	for i := 0; i < n; i++ {
+		c.send(nbdCmdRead, uint64(i), uint64(i)*4096, 4096, nil)
+	}
+	for i := n - 1; i >= 0; i-- {
+		code, h, data := c.reply(4096)
+		if code != 0 || h != uint64(i) {
+			t.Fatalf("got reply with code %d for handle %d, want handle %d", code, h, i)
+		}
+		if string(data) != string(pattern(4096, byte(i))) {
+			t.Errorf("reply %d has the wrong data", i)
+		}
+	}
+	if w := s.Workers(); w != 0 {
+		t.Errorf("%d workers started for an AsyncBlockDevice", w)
+	}
+
+	// Writes, flushes and trims are submitted too.
+	dev.lock.Lock()
+	dev.batch = 1
+	dev.lock.Unlock()
+	c.write(n, 0, pattern(4096, 0xff))
+	c.send(nbdCmdTrim, n+1, 4096, 4096, nil)
+	c.send(nbdCmdFlush, n+2, 0, 0, nil)
+	for i := 0; i < 2; i++ {
+		if code, _, _ := c.reply(0); code != 0 {
+			t.Errorf("got error %d", code)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if string(dev.data[:4096]) != string(pattern(4096, 0xff)) {
+		t.Error("write wasn't performed")
+	}
+	if dev.trims != 1 || dev.flushes != 1 {
+		t.Errorf("got %d trims and %d flushes, want 1 of each", dev.trims, dev.flushes)
+	}
+}
+
+// plainAsyncDevice is an AsyncBlockDevice which implements neither
+// BlockDeviceFlusher nor BlockDeviceTrimer, and counts submitted operations.
+type plainAsyncDevice struct {
+	BlockDevice
+	submitted atomic.Int32
+}
+
+func (d *plainAsyncDevice) Submit(op AsyncOp, complete func(error)) {
+	d.submitted.Add(1)
+	complete(handleOp(d.BlockDevice, op))
+}
+
+func TestAsyncUnsupported(t *testing.T) {
+	dev := &plainAsyncDevice{BlockDevice: newMemDevice(1 << 20)}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+
+	// Flushes and trims aren't submitted to a device which doesn't implement
+	// them.
+	c.send(nbdCmdTrim, 1, 4096, 4096, nil)
+	c.send(nbdCmdFlush, 2, 0, 0, nil)
+	for i := 0; i < 2; i++ {
+		if code, h, _ := c.reply(0); code != nbdEio {
+			t.Errorf("got error %d for handle %d, want %d", code, h, nbdEio)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if n := dev.submitted.Load(); n != 0 {
+		t.Errorf("submitted %d operations, want none", n)
+	}
+	if f := s.Stats().Failures; f != 0 {
+		t.Errorf("got %d failures, want 0", f)
+	}
+}
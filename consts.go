@@ -130,6 +130,8 @@ const (
 	nbdNlAttrClientFlags    = 6
 	nbdNlAttrSockets        = 7
 
+	nbdNlAttrBackendIdentifier = 10
+
 	nbdNlSockItem = 1
 
 	nbdNlSockFd = 1
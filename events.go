@@ -0,0 +1,129 @@
+package nbd
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType is the type of a lifecycle Event.
+type EventType int
+
+const (
+	// EventConnected is sent when the device has been connected to the server.
+	// With netlink, the device is live once the connect has succeeded. With
+	// ioctls, the device is started by NBD_DO_IT, which blocks until the device
+	// is disconnected, so the event is sent once sysfs shows the device has
+	// started, or when the first request is received if that is sooner or the
+	// device isn't found in sysfs. If the device fails to start, only
+	// EventDisconnected is sent.
+	EventConnected EventType = iota
+	// EventFirstRequest is sent when the first request is received, which shows
+	// the kernel is using the device.
+	EventFirstRequest
+	// EventPaused and EventResumed are sent when requests are paused by Pause,
+	// and resumed.
+	EventPaused
+	EventResumed
+	// EventBackendSwapped is sent when the block device has been replaced by
+	// SwapBackend.
+	EventBackendSwapped
+	// EventDegraded is sent when the device is made read-only after
+	// ErrorThreshold errors.
+	EventDegraded
+	// EventDisconnected is sent when the device has gone away. Reason and Err
+	// say why.
+	EventDisconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "Connected"
+	case EventFirstRequest:
+		return "FirstRequest"
+	case EventPaused:
+		return "Paused"
+	case EventResumed:
+		return "Resumed"
+	case EventBackendSwapped:
+		return "BackendSwapped"
+	case EventDegraded:
+		return "Degraded"
+	case EventDisconnected:
+		return "Disconnected"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// DisconnectReason is why a device was disconnected. The zero value is used
+// for events other than EventDisconnected.
+type DisconnectReason int
+
+const (
+	// DisconnectRequested means the kernel asked the server to disconnect, due
+	// to Disconnect or another process, such as nbd-client -d.
+	DisconnectRequested DisconnectReason = iota + 1
+	// DisconnectClosed means the kernel closed the connection, such as when a
+	// request timed out.
+	DisconnectClosed
+	// DisconnectErrorThreshold means the device was disconnected because the
+	// block device reached ErrorThreshold errors.
+	DisconnectErrorThreshold
+	// DisconnectFailed means the connection failed, with the error in Err.
+	DisconnectFailed
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case 0:
+		return ""
+	case DisconnectRequested:
+		return "requested"
+	case DisconnectClosed:
+		return "closed"
+	case DisconnectErrorThreshold:
+		return "error threshold"
+	case DisconnectFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("DisconnectReason(%d)", int(r))
+}
+
+// Event is a change in the lifecycle of a device.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Device is the name of the device, such as /dev/nbd0.
+	Device string
+
+	// Reason is why the device was disconnected, for EventDisconnected.
+	Reason DisconnectReason
+	// Err is the error which caused the disconnection, if any.
+	Err error
+}
+
+// connected sends EventConnected, unless it has already been sent.
+func (s *NbdServer) connected() {
+	s.connectOnce.Do(func() {
+		s.sendEvent(Event{Type: EventConnected})
+	})
+}
+
+// startFailed sends EventDisconnected for a device which failed to be set up,
+// and returns err.
+func (s *NbdServer) startFailed(err error) error {
+	// The device can't be seen to start after failing.
+	s.connectOnce.Do(func() {})
+	s.sendEvent(Event{Type: EventDisconnected, Reason: DisconnectFailed, Err: err})
+	return err
+}
+
+// sendEvent passes ev to the OnEvent callback, if set.
+func (s *NbdServer) sendEvent(ev Event) {
+	if s.opts.OnEvent == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.Device = s.name
+	s.opts.OnEvent(ev)
+}
@@ -0,0 +1,148 @@
+package nbd
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// eventRecorder records events passed to OnEvent.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(ev Event) {
+	r.lock.Lock()
+	r.events = append(r.events, ev)
+	r.lock.Unlock()
+}
+
+func (r *eventRecorder) types() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	types := make([]EventType, len(r.events))
+	for i, ev := range r.events {
+		types[i] = ev.Type
+	}
+	return fmt.Sprint(types)
+}
+
+func (r *eventRecorder) last() Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+func TestEvents(t *testing.T) {
+	for _, transport := range []string{"netlink", "ioctl"} {
+		t.Run(transport, func(t *testing.T) {
+			var rec eventRecorder
+			opts := BlockDeviceOptions{OnEvent: rec.record, Logger: testLogger()}
+			var s *NbdServer
+			var k *fakeKernel
+			if transport == "netlink" {
+				s, k = newTestServer(t, newMemDevice(1<<20), 1<<20, opts)
+			} else {
+				k = newFakeKernel(0)
+				k.ioctlSysfs = "/sys/block/nbd5"
+				var err error
+				s, err = newServerFromFd(k, 5, newMemDevice(1<<20), 1<<20, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.sysfs = k.ioctlSysfs
+			}
+			c := startServer(t, s, k)
+			waitFor(t, "the connected event", func() bool { return rec.types() == "[Connected]" })
+
+			c.read(1, 0, 4096)
+			c.read(2, 0, 4096)
+			if err := c.stop(); err != nil {
+				t.Errorf("Run: %v", err)
+			}
+			if got := rec.types(); got != "[Connected FirstRequest Disconnected]" {
+				t.Errorf("got events %s", got)
+			}
+			ev := rec.last()
+			if ev.Reason != DisconnectRequested || ev.Err != nil || ev.Device != s.name || ev.Time.IsZero() {
+				t.Errorf("got disconnected event %+v", ev)
+			}
+		})
+	}
+}
+
+func TestEventConnectionClosed(t *testing.T) {
+	var rec eventRecorder
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{OnEvent: rec.record})
+	c := startServer(t, s, k)
+
+	k.closeSock()
+	select {
+	case <-s.doneCh:
+	case <-time.After(testTimeout):
+		t.Fatal("server didn't stop")
+	}
+	if ev := rec.last(); ev.Type != EventDisconnected || ev.Reason != DisconnectClosed {
+		t.Errorf("got event %v with reason %v, want Disconnected with reason closed", ev.Type, ev.Reason)
+	}
+	s.Disconnect()
+	c.wait()
+}
+
+func TestEventsStartFails(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		setup func(k *fakeKernel)
+		// Whether the server was started, which happens before NBD_DO_IT.
+		served bool
+	}{
+		{"NBD_DO_IT", unix.EBUSY, func(k *fakeKernel) { k.doItErr = unix.EBUSY }, true},
+		{"NBD_SET_BLKSIZE", unix.EINVAL, func(k *fakeKernel) {
+			k.setupErrs = map[uintptr]error{nbdSetBlkSize: unix.EINVAL}
+		}, false},
+		{"netlink connect", unix.ENOENT, func(k *fakeKernel) { k.connectErr = unix.ENOENT }, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var rec eventRecorder
+			opts := BlockDeviceOptions{OnEvent: rec.record, Logger: testLogger()}
+			var s *NbdServer
+			var k *fakeKernel
+			if tc.name == "netlink connect" {
+				s, k = newTestServer(t, newMemDevice(1<<20), 1<<20, opts)
+			} else {
+				k = newFakeKernel(0)
+				var err error
+				s, err = newServerFromFd(k, -1, newMemDevice(1<<20), 1<<20, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.sysfs = "/sys/block/nbd5"
+			}
+			tc.setup(k)
+
+			// The device never started, so isn't connected, and the server stops.
+			if err := s.Run(); err != tc.err {
+				t.Errorf("Run returned %v, want %v", err, tc.err)
+			}
+			if tc.served {
+				select {
+				case <-s.doneCh:
+				case <-time.After(testTimeout):
+					t.Fatal("server didn't stop")
+				}
+			}
+			if got := rec.types(); got != "[Disconnected]" {
+				t.Errorf("got events %s", got)
+			}
+			if ev := rec.last(); ev.Reason != DisconnectFailed || ev.Err != tc.err {
+				t.Errorf("got disconnected event with reason %v and error %v, want failed with %v", ev.Reason, ev.Err, tc.err)
+			}
+		})
+	}
+}
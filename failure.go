@@ -0,0 +1,106 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrorAction is what the server does once the block device has failed
+// BlockDeviceOptions.ErrorThreshold requests.
+type ErrorAction int
+
+const (
+	// ErrorsContinue continues to send requests to the block device.
+	ErrorsContinue ErrorAction = iota
+	// ErrorsReadonly fails all later writes and trims with EIO, so that no
+	// more data is modified, while reads and flushes continue.
+	ErrorsReadonly
+	// ErrorsDisconnect disconnects the device.
+	ErrorsDisconnect
+)
+
+func (a ErrorAction) String() string {
+	switch a {
+	case ErrorsContinue:
+		return "continue"
+	case ErrorsReadonly:
+		return "readonly"
+	case ErrorsDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("ErrorAction(%d)", int(a))
+}
+
+var (
+	// ErrReadonly is returned for requests which modify the device after it
+	// has been made read-only by ErrorsReadonly.
+	ErrReadonly = errors.New("nbd: device is read-only due to errors")
+)
+
+// PanicError is the error of a request during which the block device
+// panicked.
+type PanicError struct {
+	// Value passed to panic.
+	Value any
+	// Stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("nbd: block device panicked: %v", e.Value)
+}
+
+// guard calls f, and returns a PanicError if it panics.
+func (s *NbdServer) guard(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{Value: r, Stack: debug.Stack()}
+			s.logger.Error("nbd: recovered panic in block device",
+				"panic", r, "stack", string(perr.Stack))
+			s.metrics.panics.Add(1)
+			err = perr
+		}
+	}()
+	return f()
+}
+
+// isFailure returns true if err indicates a failure of the block device,
+// rather than a request it doesn't support or refused.
+func isFailure(err error) bool {
+	return err != nil && !errors.Is(err, ErrUnsupported) && !errors.Is(err, ErrReadonly)
+}
+
+// recordFailure counts a failed request, and takes the ErrorAction once the
+// threshold is reached.
+func (s *NbdServer) recordFailure() {
+	n := s.failures.Add(1)
+	if s.opts.ErrorThreshold == 0 || n != int64(s.opts.ErrorThreshold) {
+		return
+	}
+	switch s.opts.ErrorAction {
+	case ErrorsReadonly:
+		s.logger.Error("nbd: error threshold reached, making device read-only",
+			"errors", s.opts.ErrorThreshold)
+		s.degraded.Store(true)
+		s.sendEvent(Event{Type: EventDegraded})
+	case ErrorsDisconnect:
+		s.logger.Error("nbd: error threshold reached, disconnecting device",
+			"errors", s.opts.ErrorThreshold)
+		s.errorDisconnect.Store(true)
+		go s.Disconnect()
+	}
+}
+
+// refuse returns ErrReadonly if req would modify a device which has been made
+// read-only due to errors.
+func (s *NbdServer) refuse(req *Request) error {
+	if !s.degraded.Load() {
+		return nil
+	}
+	switch req.cmd {
+	case nbdCmdWrite, nbdCmdTrim, nbdCmdWriteZeroes:
+		return ErrReadonly
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package nbd
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// panicDevice panics on reads at offset 0.
+type panicDevice struct {
+	*memDevice
+}
+
+func (d *panicDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off == 0 {
+		panic("bad read")
+	}
+	return d.memDevice.ReadAt(b, off)
+}
+
+func TestRecoverPanic(t *testing.T) {
+	dev := &panicDevice{memDevice: newMemDevice(1 << 20)}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{Observer: newRecordingObserver()})
+	c := startServer(t, s, k)
+
+	c.send(nbdCmdRead, 1, 0, 4096, nil)
+	if code, _, _ := c.reply(4096); code != nbdEio {
+		t.Fatalf("read which panicked replied with %d, want EIO", code)
+	}
+	// The server keeps going.
+	data := pattern(4096, 1)
+	c.write(2, 4096, data)
+	if got := c.read(3, 4096, 4096); string(got) != string(data) {
+		t.Error("read after a panic returned the wrong data")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	if st := s.Stats(); st.Panics != 1 || st.Failures != 1 || st.Degraded {
+		t.Errorf("got %d panics and %d failures, degraded %v, want 1, 1, false", st.Panics, st.Failures, st.Degraded)
+	}
+	var perr *PanicError
+	if err := s.opts.Observer.(*recordingObserver).infos[1].Err; !errors.As(err, &perr) || perr.Value != "bad read" || len(perr.Stack) == 0 {
+		t.Errorf("got error %v, want a PanicError with a stack", err)
+	}
+}
+
+func TestReadonlyAfterErrors(t *testing.T) {
+	dev := &failingDevice{memDevice: newMemDevice(1 << 20), err: errors.New("broken")}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ErrorThreshold: 1, ErrorAction: ErrorsReadonly})
+	c := startServer(t, s, k)
+
+	c.send(nbdCmdWrite, 1, 0, 4096, pattern(4096, 1))
+	if code, _, _ := c.reply(0); code != nbdEio {
+		t.Fatalf("failed write replied with %d, want EIO", code)
+	}
+	// Refused writes also fail with EIO, but reads continue.
+	c.send(nbdCmdWrite, 2, 4096, 4096, pattern(4096, 1))
+	if code, _, _ := c.reply(0); code != nbdEio {
+		t.Errorf("refused write replied with %d, want EIO", code)
+	}
+	c.read(3, 4096, 4096)
+	if st := s.Stats(); !st.Degraded || st.Failures != 1 {
+		t.Errorf("got degraded %v with %d failures, want true with 1", st.Degraded, st.Failures)
+	}
+	if string(dev.data[4096:8192]) != string(make([]byte, 4096)) {
+		t.Error("write was performed after the device was made read-only")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestDisconnectAfterErrors(t *testing.T) {
+	dev := &failingDevice{memDevice: newMemDevice(1 << 20), err: errors.New("broken")}
+	disconnected := make(chan Event, 1)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ErrorThreshold: 2,
+		ErrorAction:    ErrorsDisconnect,
+		OnEvent: func(ev Event) {
+			if ev.Type == EventDisconnected {
+				disconnected <- ev
+			}
+		},
+	})
+	c := startServer(t, s, k)
+
+	for i := uint64(1); i <= 2; i++ {
+		c.send(nbdCmdWrite, i, 0, 4096, pattern(4096, 1))
+		if code, _, _ := c.reply(0); code != nbdEio {
+			t.Fatalf("failed write replied with %d, want EIO", code)
+		}
+	}
+	if err := c.wait(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	select {
+	case ev := <-disconnected:
+		if ev.Reason != DisconnectErrorThreshold {
+			t.Errorf("disconnected with reason %v, want %v", ev.Reason, DisconnectErrorThreshold)
+		}
+	case <-time.After(testTimeout):
+		t.Error("no disconnected event")
+	}
+}
+
+// failingGatedDevice is a gatedDevice which fails writes at offset 0.
+type failingGatedDevice struct {
+	*gatedDevice
+}
+
+func (d *failingGatedDevice) WriteAt(b []byte, off int64) (int, error) {
+	n, err := d.gatedDevice.WriteAt(b, off)
+	if off == 0 {
+		return 0, errors.New("broken")
+	}
+	return n, err
+}
+
+func TestCoalescedWriteFailure(t *testing.T) {
+	const workers = 3
+	dev := &failingGatedDevice{gatedDevice: newGatedDevice(1 << 20)}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ConcurrentOps:    workers,
+		MaxCoalesceBytes: workers * 4096,
+		ErrorThreshold:   2,
+		ErrorAction:      ErrorsReadonly,
+	})
+	c := startServer(t, s, k)
+
+	// Queue adjacent writes while every worker is busy, so that they are
+	// merged into a single write which fails.
+	for i := 0; i < workers; i++ {
+		c.send(nbdCmdWrite, uint64(100+i), uint64(i+1)*65536, 4096, pattern(4096, 0))
+		dev.expectStart(t, int64(i+1)*65536)
+	}
+	for i := 0; i < workers; i++ {
+		c.send(nbdCmdWrite, uint64(i), uint64(i)*4096, 4096, pattern(4096, 1))
+	}
+	waitFor(t, "writes to be queued", func() bool { return s.Stats().QueueDepth == workers })
+	dev.release(t, 65536)
+	dev.expectStart(t, 0)
+	dev.release(t, 0)
+	for i := 1; i < workers; i++ {
+		dev.release(t, int64(i+1)*65536)
+	}
+
+	for i := 0; i < 2*workers; i++ {
+		if code, h, _ := c.reply(0); (code != 0) != (h < workers) {
+			t.Errorf("got error %d for handle %d", code, h)
+		}
+	}
+	// The merged writes are a single failure of the block device.
+	if st := s.Stats(); st.Degraded || st.Failures != 1 {
+		t.Errorf("got degraded %v with %d failures, want false with 1", st.Degraded, st.Failures)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ioctlCall is a single ioctl recorded by fakeKernel.
+type ioctlCall struct {
+	req uintptr
+	arg uintptr
+}
+
+// netlinkRequest is a decoded nbd generic netlink request recorded by
+// fakeKernel. Attributes which weren't present are left as zero.
+type netlinkRequest struct {
+	cmd            uint8
+	index          uint32
+	sizeBytes      uint64
+	blockSizeBytes uint64
+	timeout        uint64
+	serverFlags    uint64
+	clientFlags    uint64
+	backendId      string
+	sockets        []int
+}
+
+// fakeKernel is a kernelControl which records ioctls and netlink requests
+// instead of issuing them to the kernel. Like the real driver, NBD_DO_IT
+// blocks until the device is disconnected, and disconnecting sends a
+// disconnect request over the socket handed to the "kernel".
+type fakeKernel struct {
+	// family is returned by the fake generic netlink connection. If family.ID
+	// is 0, the "nbd" family doesn't exist.
+	family genetlink.Family
+	// policyAttrs are the attributes in the policy of the "nbd" family. If
+	// nil, the policy can't be dumped, as before Linux 5.8.
+	policyAttrs []uint16
+	// doItErr, if set, is returned by NBD_DO_IT instead of starting the
+	// device.
+	doItErr error
+	// setupErrs are returned by the ioctls with the given requests, other than
+	// NBD_DO_IT, instead of performing them.
+	setupErrs map[uintptr]error
+	// connectErr, if set, is returned by netlink connect requests.
+	connectErr error
+	// openErr, if set, is returned when opening the device.
+	openErr error
+	// connectGate, if set, is received from before a netlink connect request
+	// connects the device.
+	connectGate chan struct{}
+	// ioctlSysfs is the sysfs directory of the device used with ioctls, which
+	// shows the device as started by NBD_DO_IT.
+	ioctlSysfs string
+
+	lock   sync.Mutex
+	opened []string
+	// Device size set by ioctls.
+	blockSize, sizeBlocks uintptr
+	ioctls                []ioctlCall
+	nlReqs                []netlinkRequest
+	sockFd                int
+	// Contents of sysfs and procfs files.
+	files map[string]string
+
+	sockCh    chan struct{}
+	sockOnce  sync.Once
+	startCh   chan struct{}
+	startOnce sync.Once
+	discCh    chan struct{}
+	discOnce  sync.Once
+}
+
+func newFakeKernel(netlinkVersion uint8) *fakeKernel {
+	k := &fakeKernel{
+		sockFd:  -1,
+		files:   make(map[string]string),
+		sockCh:  make(chan struct{}),
+		startCh: make(chan struct{}),
+		discCh:  make(chan struct{}),
+	}
+	if netlinkVersion > 0 {
+		k.family = genetlink.Family{ID: 0x20, Version: netlinkVersion, Name: nbdNlFamilyName}
+		for attr := uint16(nbdNlAttrIndex); attr <= nbdNlAttrBackendIdentifier; attr++ {
+			k.policyAttrs = append(k.policyAttrs, attr)
+		}
+	}
+	return k
+}
+
+// openDevice opens /dev/null in place of the device, so that the descriptor
+// can be closed like a real one.
+func (k *fakeKernel) openDevice(path string) (int, error) {
+	k.lock.Lock()
+	k.opened = append(k.opened, path)
+	k.lock.Unlock()
+	if k.openErr != nil {
+		return -1, k.openErr
+	}
+	return unix.Open(os.DevNull, unix.O_RDWR|unix.O_CLOEXEC, 0)
+}
+
+func (k *fakeKernel) ioctl(devFd int, req, arg uintptr) error {
+	k.lock.Lock()
+	k.ioctls = append(k.ioctls, ioctlCall{req: req, arg: arg})
+	k.lock.Unlock()
+	if err := k.setupErrs[req]; err != nil {
+		return err
+	}
+
+	switch req {
+	case nbdSetSock:
+		k.setSock(int(arg))
+	case nbdSetBlkSize:
+		k.lock.Lock()
+		k.blockSize = arg
+		k.lock.Unlock()
+	case nbdSetSizeBlocks:
+		k.lock.Lock()
+		k.sizeBlocks = arg
+		k.lock.Unlock()
+	case nbdDoIt:
+		if k.doItErr != nil {
+			return k.doItErr
+		}
+		if k.ioctlSysfs != "" {
+			k.lock.Lock()
+			k.files[k.ioctlSysfs+"/size"] = fmt.Sprintf("%d\n", k.blockSize*k.sizeBlocks/512)
+			k.files[k.ioctlSysfs+"/pid"] = fmt.Sprintf("%d\n", os.Getpid())
+			k.lock.Unlock()
+		}
+		k.start()
+		<-k.discCh
+	case nbdDisconnect, nbdClearSock:
+		k.disconnect()
+	}
+	return nil
+}
+
+func (k *fakeKernel) dialNetlink() (genetlinkConn, error) {
+	return &fakeGenetlinkConn{k: k}, nil
+}
+
+func (k *fakeKernel) readFile(name string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	data, ok := k.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(data), nil
+}
+
+func (k *fakeKernel) setSock(fd int) {
+	k.sockOnce.Do(func() {
+		k.lock.Lock()
+		k.sockFd = fd
+		k.lock.Unlock()
+		close(k.sockCh)
+	})
+}
+
+func (k *fakeKernel) disconnect() {
+	k.discOnce.Do(func() {
+		k.lock.Lock()
+		fd := k.sockFd
+		k.lock.Unlock()
+		if fd >= 0 {
+			var req [requestHeaderSize]byte
+			binary.BigEndian.PutUint32(req[:], nbdRequestMagic)
+			binary.BigEndian.PutUint16(req[6:], nbdCmdDisc)
+			unix.Write(fd, req[:])
+		}
+		close(k.discCh)
+	})
+}
+
+// setFile sets the contents of a sysfs or procfs file.
+func (k *fakeKernel) setFile(name, data string) {
+	k.lock.Lock()
+	k.files[name] = data
+	k.lock.Unlock()
+}
+
+// closeSock shuts down the kernel's end of the socket, as the kernel does
+// when a request times out.
+func (k *fakeKernel) closeSock() {
+	k.lock.Lock()
+	fd := k.sockFd
+	k.lock.Unlock()
+	unix.Shutdown(fd, unix.SHUT_RDWR)
+}
+
+// start marks the device as started, by NBD_DO_IT or a netlink connect
+// request.
+func (k *fakeKernel) start() {
+	k.startOnce.Do(func() { close(k.startCh) })
+}
+
+// started blocks until the device has been started.
+func (k *fakeKernel) started() {
+	<-k.startCh
+}
+
+// ioctlCalls returns the ioctls issued so far, in order.
+func (k *fakeKernel) ioctlCalls() []ioctlCall {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return append([]ioctlCall(nil), k.ioctls...)
+}
+
+// netlinkRequests returns the netlink requests issued so far, in order.
+func (k *fakeKernel) netlinkRequests() []netlinkRequest {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return append([]netlinkRequest(nil), k.nlReqs...)
+}
+
+// kernelSocket blocks until a socket has been handed to the fake kernel, and
+// returns the kernel's end of it. The caller owns the returned file.
+func (k *fakeKernel) kernelSocket() (*os.File, error) {
+	<-k.sockCh
+	k.lock.Lock()
+	fd := k.sockFd
+	k.lock.Unlock()
+	dupFd, err := unix.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(dupFd), "nbd-kernel-sock"), nil
+}
+
+type fakeGenetlinkConn struct {
+	k *fakeKernel
+}
+
+func (c *fakeGenetlinkConn) GetFamily(name string) (genetlink.Family, error) {
+	if c.k.family.ID == 0 || name != c.k.family.Name {
+		return genetlink.Family{}, fmt.Errorf("genetlink: family %q: %w", name, os.ErrNotExist)
+	}
+	return c.k.family, nil
+}
+
+func (c *fakeGenetlinkConn) Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	if family == unix.GENL_ID_CTRL {
+		return c.getPolicy(m)
+	}
+	_, err := c.Send(m, family, flags)
+	if err != nil {
+		return nil, err
+	}
+	return []genetlink.Message{{Header: m.Header}}, nil
+}
+
+func (c *fakeGenetlinkConn) Send(m genetlink.Message, family uint16, flags netlink.HeaderFlags) (netlink.Message, error) {
+	if family != c.k.family.ID || family == 0 {
+		return netlink.Message{}, unix.ENOENT
+	}
+	req, err := decodeNetlinkRequest(m)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	c.k.lock.Lock()
+	c.k.nlReqs = append(c.k.nlReqs, req)
+	c.k.lock.Unlock()
+
+	switch req.cmd {
+	case nbdNlCmdConnect:
+		if len(req.sockets) == 0 {
+			return netlink.Message{}, unix.EINVAL
+		}
+		if c.k.connectErr != nil {
+			return netlink.Message{}, c.k.connectErr
+		}
+		if c.k.connectGate != nil {
+			<-c.k.connectGate
+		}
+		c.k.setSock(req.sockets[0])
+		dir := fmt.Sprintf("/sys/block/nbd%d/", req.index)
+		c.k.lock.Lock()
+		c.k.files[dir+"size"] = fmt.Sprintf("%d\n", req.sizeBytes/512)
+		c.k.files[dir+"pid"] = fmt.Sprintf("%d\n", os.Getpid())
+		c.k.lock.Unlock()
+		c.k.start()
+	case nbdNlCmdDisconnect:
+		c.k.disconnect()
+	}
+	return netlink.Message{}, nil
+}
+
+// getPolicy replies to CTRL_CMD_GETPOLICY for the "nbd" family, with its
+// policy followed by the policy of a nested attribute.
+func (c *fakeGenetlinkConn) getPolicy(m genetlink.Message) ([]genetlink.Message, error) {
+	if m.Header.Command != unix.CTRL_CMD_GETPOLICY || c.k.policyAttrs == nil {
+		return nil, unix.EOPNOTSUPP
+	}
+	ad, err := netlink.NewAttributeDecoder(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	for ad.Next() {
+		if ad.Type() == unix.CTRL_ATTR_FAMILY_ID && ad.Uint16() != c.k.family.ID {
+			return nil, unix.ENOENT
+		}
+	}
+
+	var msgs []genetlink.Message
+	policies := [][]uint16{c.k.policyAttrs, {nbdNlSockItem}}
+	for i, attrs := range policies {
+		for _, attr := range attrs {
+			enc := netlink.NewAttributeEncoder()
+			enc.Uint16(unix.CTRL_ATTR_FAMILY_ID, c.k.family.ID)
+			enc.Nested(unix.CTRL_ATTR_POLICY, func(pae *netlink.AttributeEncoder) error {
+				pae.Nested(uint16(i), func(aae *netlink.AttributeEncoder) error {
+					aae.Nested(attr, func(tae *netlink.AttributeEncoder) error {
+						tae.Uint32(unix.NL_POLICY_TYPE_ATTR_TYPE, unix.NL_ATTR_TYPE_U32)
+						return nil
+					})
+					return nil
+				})
+				return nil
+			})
+			data, err := enc.Encode()
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, genetlink.Message{Header: m.Header, Data: data})
+		}
+	}
+	return msgs, nil
+}
+
+func (c *fakeGenetlinkConn) Close() error {
+	return nil
+}
+
+func decodeNetlinkRequest(m genetlink.Message) (netlinkRequest, error) {
+	req := netlinkRequest{cmd: m.Header.Command}
+	ad, err := netlink.NewAttributeDecoder(m.Data)
+	if err != nil {
+		return req, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case nbdNlAttrIndex:
+			req.index = ad.Uint32()
+		case nbdNlAttrSizeBytes:
+			req.sizeBytes = ad.Uint64()
+		case nbdNlAttrBlockSizeBytes:
+			req.blockSizeBytes = ad.Uint64()
+		case nbdNlAttrTimeout:
+			req.timeout = ad.Uint64()
+		case nbdNlAttrServerFlags:
+			req.serverFlags = ad.Uint64()
+		case nbdNlAttrClientFlags:
+			req.clientFlags = ad.Uint64()
+		case nbdNlAttrBackendIdentifier:
+			req.backendId = ad.String()
+		case nbdNlAttrSockets:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() != nbdNlSockItem {
+						return fmt.Errorf("unexpected socket attribute %d", nad.Type())
+					}
+					nad.Nested(func(sad *netlink.AttributeDecoder) error {
+						for sad.Next() {
+							if sad.Type() == nbdNlSockFd {
+								req.sockets = append(req.sockets, int(sad.Uint32()))
+							}
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		default:
+			return req, fmt.Errorf("unexpected attribute %d", ad.Type())
+		}
+	}
+	return req, ad.Err()
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -25,6 +25,11 @@ func NewFileBlockDevice(file *os.File) *FileBlockDevice {
 	return &FileBlockDevice{File: file}
 }
 
+// BackingFd allows the server to splice data to and from the file.
+func (f *FileBlockDevice) BackingFd() uintptr {
+	return f.Fd()
+}
+
 func (f *FileBlockDevice) Flush() error {
 	return f.File.Sync()
 }
@@ -34,7 +39,7 @@ func (f *FileBlockDevice) Trim(off int64, length uint32) error {
 		return nil
 	}
 
-	log.Printf("Trim off: %d, len: %d", off, length)
+	slog.Debug("Trim", "offset", off, "length", length)
 	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE|unix.FALLOC_FL_PUNCH_HOLE, off, int64(length))
 	if err != nil {
 		if errno, ok := err.(syscall.Errno); ok {
@@ -42,18 +47,18 @@ func (f *FileBlockDevice) Trim(off int64, length uint32) error {
 			case unix.ENOSYS:
 				punchHoleUnsupported.Store(true)
 				enosysOnce.Do(func() {
-					log.Println("fallocate() not supported")
+					slog.Warn("fallocate() not supported")
 				})
 				return nil
 			case unix.EOPNOTSUPP:
 				punchHoleUnsupported.Store(true)
 				eopnotsupOnce.Do(func() {
-					log.Println("fallocate(FALLOC_FL_PUNCH_HOLE) not supported on this filesystem")
+					slog.Warn("fallocate(FALLOC_FL_PUNCH_HOLE) not supported on this filesystem")
 				})
 				return nil
 			}
 		}
-		log.Println("fallocate() error: ", err)
+		slog.Error("fallocate() error", "offset", off, "length", length, "error", err)
 	}
 	return err
 }
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/akmistry/go-nbd"
 )
@@ -19,11 +22,22 @@ const (
 var (
 	dev  = flag.String("device", "/dev/nbd0", "Path to /deb/nbdX device.")
 	file = flag.String("file", "", "Path to file to use as block device.")
+	rot  = flag.Bool("rotational", false, "Advertise the block device as rotational.")
+	dbg  = flag.Bool("debug", false, "Log per-request events.")
+	uid  = flag.Int("uid", -1, "User to switch to once the device is set up.")
+	gid  = flag.Int("gid", -1, "Group to switch to once the device is set up.")
 )
 
 func main() {
 	flag.Parse()
 
+	level := slog.LevelInfo
+	if *dbg {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
 	go func() {
 		log.Println("http: ", http.ListenAndServe("localhost:6060", nil))
 	}()
@@ -48,12 +62,40 @@ func main() {
 
 	opts := nbd.BlockDeviceOptions{
 		BlockSize: blockSize,
+		Logger:    logger,
+		DeviceCharacteristics: nbd.DeviceCharacteristics{
+			Rotational: *rot,
+		},
+	}
+	if *uid >= 0 || *gid >= 0 {
+		priv := nbd.Privileges{Uid: *uid, Gid: *gid}
+		// Check before the device is set up, since Drop failing would tear it
+		// down again.
+		if err := priv.Validate(); err != nil {
+			log.Println("invalid -uid or -gid: ", err)
+			return
+		}
+		opts.DropPrivileges = priv.Drop
 	}
 	nbdDevice, err := nbd.NewServer(*dev, NewFileBlockDevice(f), size, opts)
 	if err != nil {
 		log.Panicln(err)
 	}
 
+	http.Handle("/metrics", nbdDevice.MetricsHandler())
+	http.Handle("/debug/nbd", nbdDevice.DebugHandler())
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := nbdDevice.WaitReady(ctx)
+		if err != nil {
+			log.Println("nbd: device not ready: ", err)
+			return
+		}
+		log.Println("nbd: device ready")
+	}()
+
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
 	go func() {
@@ -0,0 +1,165 @@
+package nbd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// InFlightRequest describes a request which has been received, and not yet
+// completed by the block device.
+type InFlightRequest struct {
+	Command Command
+	Handle  uint64
+	Offset  uint64
+	Length  uint32
+
+	// Worker is the ID of the worker performing the request, or -1 if it is
+	// waiting for a worker or was submitted to an AsyncBlockDevice.
+	Worker int
+
+	// Received is when the request was read from the kernel.
+	Received time.Time
+	// Dispatched is when the request was passed to the block device, or zero
+	// if it is waiting, either for a worker or for overlapping requests.
+	Dispatched time.Time
+
+	// Duplicate is true if another request with the same handle was in flight
+	// when this one was received.
+	Duplicate bool
+}
+
+// inFlightTracker tracks in-flight requests by handle.
+type inFlightTracker struct {
+	lock       sync.Mutex
+	handles    map[uint64][]*InFlightRequest
+	duplicates uint64
+}
+
+// add tracks req, and returns false if its handle is already in use.
+func (t *inFlightTracker) add(req *Request) bool {
+	req.flight = &InFlightRequest{
+		Command:  Command(req.cmd),
+		Handle:   req.handle,
+		Offset:   req.offset,
+		Length:   req.length,
+		Worker:   -1,
+		Received: req.received,
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.handles == nil {
+		t.handles = make(map[uint64][]*InFlightRequest)
+	}
+	reqs := t.handles[req.handle]
+	if len(reqs) > 0 {
+		req.flight.Duplicate = true
+		t.duplicates++
+	}
+	t.handles[req.handle] = append(reqs, req.flight)
+	return len(reqs) == 0
+}
+
+// dispatched records that worker has started performing req.
+func (t *inFlightTracker) dispatched(req *Request, worker int) {
+	if req.flight == nil {
+		return
+	}
+	t.lock.Lock()
+	req.flight.Worker = worker
+	req.flight.Dispatched = time.Now()
+	t.lock.Unlock()
+}
+
+// remove stops tracking req.
+func (t *inFlightTracker) remove(req *Request) {
+	if req.flight == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	reqs := t.handles[req.handle]
+	for i, r := range reqs {
+		if r == req.flight {
+			reqs = append(reqs[:i], reqs[i+1:]...)
+			break
+		}
+	}
+	if len(reqs) == 0 {
+		delete(t.handles, req.handle)
+	} else {
+		t.handles[req.handle] = reqs
+	}
+	req.flight = nil
+}
+
+// reset stops tracking all requests, when the connection is closed.
+func (t *inFlightTracker) reset() {
+	t.lock.Lock()
+	t.handles = nil
+	t.lock.Unlock()
+}
+
+func (t *inFlightTracker) duplicateHandles() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.duplicates
+}
+
+// list returns the in-flight requests, oldest first.
+func (t *inFlightTracker) list() []InFlightRequest {
+	t.lock.Lock()
+	var reqs []InFlightRequest
+	for _, rs := range t.handles {
+		for _, r := range rs {
+			reqs = append(reqs, *r)
+		}
+	}
+	t.lock.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].Received.Before(reqs[j].Received)
+	})
+	return reqs
+}
+
+// InFlightRequests returns the requests which have been received and not yet
+// completed by the block device, oldest first.
+func (s *NbdServer) InFlightRequests() []InFlightRequest {
+	return s.inFlight.list()
+}
+
+// DebugHandler returns an http.Handler which serves a plain text page listing
+// the server's in-flight requests.
+func (s *NbdServer) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		now := time.Now()
+		reqs := s.InFlightRequests()
+		fmt.Fprintf(w, "device %s: %d requests in flight, %d workers, %d duplicate handles\n\n",
+			s.name, len(reqs), s.Workers(), s.inFlight.duplicateHandles())
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "HANDLE\tOP\tOFFSET\tLENGTH\tWORKER\tAGE\tSTATE")
+		for _, req := range reqs {
+			worker := "-"
+			state := "waiting"
+			if !req.Dispatched.IsZero() {
+				state = fmt.Sprintf("running %v", now.Sub(req.Dispatched))
+			}
+			if req.Worker >= 0 {
+				worker = fmt.Sprint(req.Worker)
+			}
+			if req.Duplicate {
+				state += " (duplicate handle)"
+			}
+			fmt.Fprintf(tw, "%#x\t%v\t%d\t%d\t%s\t%v\t%s\n",
+				req.Handle, req.Command, req.Offset, req.Length, worker, now.Sub(req.Received), state)
+		}
+		tw.Flush()
+	})
+}
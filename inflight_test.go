@@ -0,0 +1,57 @@
+package nbd
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInFlightRequests(t *testing.T) {
+	dev := newGatedDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 1})
+	c := startServer(t, s, k)
+
+	// The second request reuses the handle of the first, and waits for the
+	// only worker.
+	c.send(nbdCmdRead, 7, 0, 4096, nil)
+	dev.expectStart(t, 0)
+	c.send(nbdCmdWrite, 7, 8192, 4096, pattern(4096, 1))
+	waitFor(t, "both requests to be in flight", func() bool { return len(s.InFlightRequests()) == 2 })
+
+	reqs := s.InFlightRequests()
+	if r := reqs[0]; r.Command != CmdRead || r.Handle != 7 || r.Offset != 0 || r.Worker != 0 || r.Dispatched.IsZero() || r.Duplicate {
+		t.Errorf("got running request %+v", r)
+	}
+	if r := reqs[1]; r.Command != CmdWrite || r.Offset != 8192 || r.Worker != -1 || !r.Dispatched.IsZero() || !r.Duplicate {
+		t.Errorf("got waiting request %+v", r)
+	}
+
+	rec := httptest.NewRecorder()
+	s.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug", nil))
+	page := rec.Body.String()
+	for _, want := range []string{"2 requests in flight", "1 duplicate handles", "running", "waiting (duplicate handle)"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("debug page doesn't contain %q:\n%s", want, page)
+		}
+	}
+
+	dev.release(t, 0)
+	dev.expectStart(t, 8192)
+	dev.release(t, 8192)
+	// The only worker performs the requests in order.
+	if code, _, _ := c.reply(4096); code != 0 {
+		t.Errorf("read failed with %d", code)
+	}
+	if code, _, _ := c.reply(0); code != 0 {
+		t.Errorf("write failed with %d", code)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if reqs := s.InFlightRequests(); len(reqs) != 0 {
+		t.Errorf("got %d requests in flight after stopping", len(reqs))
+	}
+	if n := s.Stats().DuplicateHandles; n != 1 {
+		t.Errorf("got %d duplicate handles, want 1", n)
+	}
+}
@@ -0,0 +1,57 @@
+package nbd
+
+import (
+	"os"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// kernelControl is the interface used to configure the kernel nbd driver,
+// either through ioctls on the device or through generic netlink. It allows
+// the kernel to be replaced by a fake.
+type kernelControl interface {
+	// openDevice opens the nbd device at path for ioctls.
+	openDevice(path string) (int, error)
+
+	// ioctl issues the nbd ioctl req on the device devFd.
+	ioctl(devFd int, req, arg uintptr) error
+
+	// dialNetlink opens a generic netlink connection.
+	dialNetlink() (genetlinkConn, error)
+
+	// readFile reads a sysfs or procfs file.
+	readFile(name string) ([]byte, error)
+}
+
+// genetlinkConn is the subset of *genetlink.Conn used by NetlinkConn.
+type genetlinkConn interface {
+	GetFamily(name string) (genetlink.Family, error)
+	Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error)
+	Send(m genetlink.Message, family uint16, flags netlink.HeaderFlags) (netlink.Message, error)
+	Close() error
+}
+
+// sysKernel is the kernelControl which talks to the running kernel.
+type sysKernel struct{}
+
+func (sysKernel) openDevice(path string) (int, error) {
+	return unix.Open(path, unix.O_RDWR, 0)
+}
+
+func (sysKernel) ioctl(devFd int, req, arg uintptr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(devFd), req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (sysKernel) dialNetlink() (genetlinkConn, error) {
+	return genetlink.Dial(&netlink.Config{Strict: true})
+}
+
+func (sysKernel) readFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
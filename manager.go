@@ -0,0 +1,338 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrManagerClosed = errors.New("nbd: manager is shut down")
+	ErrNoFreeDevice  = errors.New("nbd: no free nbd device")
+)
+
+// ManagerOptions configures a Manager.
+type ManagerOptions struct {
+	// MaxWorkers, if non-zero, limits the total number of workers performing
+	// requests across all devices. Each device which has received a request
+	// always has at least one worker, so the limit can be exceeded by devices
+	// with few workers.
+	MaxWorkers int
+
+	// MaxInFlightBytes, if non-zero, limits the total size of request and
+	// reply data buffers in use across all devices. It replaces the
+	// MaxInFlightBytes of each device.
+	MaxInFlightBytes int64
+
+	// Logger is used to log manager events, and by devices which don't have
+	// their own. If nil, slog.Default() is used.
+	Logger *slog.Logger
+}
+
+// Manager runs many nbd devices in one process. Each device has a name, used
+// to refer to it, and in Stats and metrics. Devices share the worker and
+// buffer budgets of the manager.
+type Manager struct {
+	opts   ManagerOptions
+	kc     kernelControl
+	logger *slog.Logger
+
+	workers  *workerBudget
+	bufLimit *memLimiter
+
+	lock    sync.Mutex
+	devices map[string]*managedDevice
+	closed  bool
+	running sync.WaitGroup
+}
+
+type managedDevice struct {
+	s     *NbdServer
+	index int
+	// connected is closed once the device has connected or failed to.
+	connected chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+// disconnect disconnects the device, once it has connected. Disconnecting
+// before then has no effect, and the device would connect anyway.
+func (d *managedDevice) disconnect() {
+	select {
+	case <-d.connected:
+	case <-d.done:
+		return
+	}
+	d.s.Disconnect()
+}
+
+func NewManager(opts ManagerOptions) (*Manager, error) {
+	return newManager(sysKernel{}, opts)
+}
+
+func newManager(kc kernelControl, opts ManagerOptions) (*Manager, error) {
+	if opts.MaxWorkers < 0 {
+		return nil, errors.New("nbd: MaxWorkers must be non-negative")
+	}
+	if opts.MaxInFlightBytes < 0 {
+		return nil, errors.New("nbd: MaxInFlightBytes must be non-negative")
+	}
+	m := &Manager{
+		opts:    opts,
+		kc:      kc,
+		logger:  opts.Logger,
+		devices: make(map[string]*managedDevice),
+	}
+	if m.logger == nil {
+		m.logger = slog.Default()
+	}
+	if opts.MaxWorkers > 0 {
+		m.workers = &workerBudget{limit: int64(opts.MaxWorkers)}
+	}
+	if opts.MaxInFlightBytes > 0 {
+		m.bufLimit = newMemLimiter(opts.MaxInFlightBytes)
+	}
+	return m, nil
+}
+
+// Create starts a device named name on a free nbd device, and returns its
+// server. A free device is one which isn't connected to any server.
+func (m *Manager) Create(name string, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	return m.add(name, -1, block, size, opts)
+}
+
+// Attach starts a device named name on the nbd device with the given index
+// (i.e. /dev/nbd<index>), and returns its server.
+func (m *Manager) Attach(name string, index int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	if index < 0 {
+		return nil, errors.New("nbd: index must be non-negative")
+	}
+	return m.add(name, index, block, size, opts)
+}
+
+func (m *Manager) add(name string, index int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	if name == "" {
+		return nil, errors.New("nbd: device name must not be empty")
+	}
+	if opts.Logger == nil {
+		opts.Logger = m.logger.With("name", name)
+	}
+	// Wait for the device to be connected, so that it can be disconnected.
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	var started bool
+	onEvent := opts.OnEvent
+	opts.OnEvent = func(ev Event) {
+		if ev.Type == EventConnected || ev.Type == EventDisconnected {
+			connectedOnce.Do(func() {
+				started = ev.Type == EventConnected
+				close(connected)
+			})
+		}
+		if onEvent != nil {
+			onEvent(ev)
+		}
+	}
+
+	d, err := m.start(name, index, block, size, opts, connected)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-connected:
+	case <-d.done:
+		return nil, d.err
+	}
+	if !started {
+		// The device may have failed to start, in which case Run returns the
+		// error.
+		<-d.done
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+	m.logger.Info("nbd: created device", "name", name, "device", d.s.name)
+	return d.s, nil
+}
+
+// start creates the server of a device, and runs it. A free index is chosen
+// if index is negative.
+func (m *Manager) start(name string, index int, block BlockDevice, size int64, opts BlockDeviceOptions, connected chan struct{}) (*managedDevice, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if _, ok := m.devices[name]; ok {
+		return nil, fmt.Errorf("nbd: device %q already exists", name)
+	}
+	if index < 0 {
+		index = m.freeIndexLocked()
+		if index < 0 {
+			return nil, ErrNoFreeDevice
+		}
+	} else {
+		for other, d := range m.devices {
+			if d.index == index {
+				return nil, fmt.Errorf("nbd: %s is used by device %q", DevicePath(index), other)
+			}
+		}
+	}
+
+	s, err := newServerAuto(m.kc, index, block, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.workerBudget = m.workers
+	if m.bufLimit != nil {
+		// Bytes in use are counted for each device as well as by the manager.
+		s.bufLimit = m.bufLimit.child()
+		s.reqPool.limit = s.bufLimit
+		s.replyPool.limit = s.bufLimit
+	}
+
+	d := &managedDevice{s: s, index: index, connected: connected, done: make(chan struct{})}
+	m.devices[name] = d
+	m.running.Add(1)
+	go m.run(name, d)
+	return d, nil
+}
+
+// freeIndexLocked returns the lowest index of an nbd device which isn't
+// connected, or -1 if there are none. The kernel creates the pid attribute of
+// a device when it is connected.
+func (m *Manager) freeIndexLocked() int {
+	used := make(map[int]bool, len(m.devices))
+	for _, d := range m.devices {
+		used[d.index] = true
+	}
+	for i := 0; ; i++ {
+		dir := fmt.Sprintf("/sys/block/nbd%d/", i)
+		if _, err := m.kc.readFile(dir + "size"); err != nil {
+			// No more devices.
+			return -1
+		}
+		if used[i] {
+			continue
+		}
+		if _, err := m.kc.readFile(dir + "pid"); errors.Is(err, os.ErrNotExist) {
+			return i
+		}
+	}
+}
+
+func (m *Manager) run(name string, d *managedDevice) {
+	defer m.running.Done()
+	d.err = d.s.Run()
+	if d.err != nil {
+		m.logger.Error("nbd: device stopped", "name", name, "error", d.err)
+	} else {
+		m.logger.Info("nbd: device stopped", "name", name)
+	}
+
+	m.lock.Lock()
+	if m.devices[name] == d {
+		delete(m.devices, name)
+	}
+	m.lock.Unlock()
+	close(d.done)
+}
+
+// Detach disconnects the device named name, and waits for it to stop. The
+// error returned by its server's Run is returned. Devices which stop by
+// themselves, such as when disconnected by another process, are detached
+// automatically.
+func (m *Manager) Detach(name string) error {
+	m.lock.Lock()
+	d, ok := m.devices[name]
+	m.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("nbd: no device %q", name)
+	}
+	d.disconnect()
+	<-d.done
+	return d.err
+}
+
+// Device returns the server of the device named name, or nil if there is no
+// such device.
+func (m *Manager) Device(name string) *NbdServer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if d, ok := m.devices[name]; ok {
+		return d.s
+	}
+	return nil
+}
+
+// Names returns the names of the devices, in sorted order.
+func (m *Manager) Names() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.devices))
+	for name := range m.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stats returns a snapshot of the statistics of each device, keyed by name.
+func (m *Manager) Stats() map[string]Stats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := make(map[string]Stats, len(m.devices))
+	for name, d := range m.devices {
+		stats[name] = d.s.Stats()
+	}
+	return stats
+}
+
+// MetricsHandler returns an http.Handler which serves the Stats of every
+// device in the Prometheus text exposition format, with devices labelled by
+// name.
+func (m *Manager) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, m.Stats())
+	})
+}
+
+// Shutdown disconnects every device, and waits for them to stop. No devices
+// can be added afterwards.
+func (m *Manager) Shutdown() {
+	m.lock.Lock()
+	m.closed = true
+	devices := make([]*managedDevice, 0, len(m.devices))
+	for _, d := range m.devices {
+		devices = append(devices, d)
+	}
+	m.lock.Unlock()
+
+	for _, d := range devices {
+		d.disconnect()
+	}
+	m.running.Wait()
+}
+
+// ShutdownOnSignal calls Shutdown when one of sigs is received.
+func (m *Manager) ShutdownOnSignal(sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		sig := <-ch
+		signal.Stop(ch)
+		m.logger.Info("nbd: shutting down on signal", "signal", sig)
+		m.Shutdown()
+	}()
+}
+
+// Wait waits until every device has stopped.
+func (m *Manager) Wait() {
+	m.running.Wait()
+}
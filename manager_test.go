@@ -0,0 +1,307 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// multiKernel is a kernelControl with n nbd devices, each of which is a
+// fakeKernel using netlink.
+type multiKernel struct {
+	n int
+
+	lock    sync.Mutex
+	kernels map[int]*fakeKernel
+}
+
+func newMultiKernel(n int) *multiKernel {
+	return &multiKernel{n: n, kernels: make(map[int]*fakeKernel)}
+}
+
+// kernel returns the fake kernel of the device with the given index.
+func (m *multiKernel) kernel(index int) *fakeKernel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	k, ok := m.kernels[index]
+	if !ok {
+		k = newFakeKernel(nbdNlVersion)
+		m.kernels[index] = k
+	}
+	return k
+}
+
+func (m *multiKernel) openDevice(path string) (int, error) {
+	return -1, errors.New("ioctl not supported")
+}
+
+func (m *multiKernel) ioctl(devFd int, req, arg uintptr) error {
+	return errors.New("ioctl not supported")
+}
+
+func (m *multiKernel) dialNetlink() (genetlinkConn, error) {
+	return multiConn{m}, nil
+}
+
+func (m *multiKernel) readFile(name string) ([]byte, error) {
+	var index int
+	var attr string
+	if _, err := fmt.Sscanf(name, "/sys/block/nbd%d/%s", &index, &attr); err != nil {
+		return m.kernel(0).readFile(name)
+	}
+	if index >= m.n {
+		return nil, os.ErrNotExist
+	}
+	b, err := m.kernel(index).readFile(name)
+	if attr == "size" && err != nil {
+		// Devices exist before they are connected.
+		return []byte("0\n"), nil
+	}
+	return b, err
+}
+
+// multiConn passes netlink requests to the kernel of the device they're for.
+type multiConn struct {
+	m *multiKernel
+}
+
+func (c multiConn) conn(msg genetlink.Message) *fakeGenetlinkConn {
+	req, _ := decodeNetlinkRequest(msg)
+	return &fakeGenetlinkConn{c.m.kernel(int(req.index))}
+}
+
+func (c multiConn) GetFamily(name string) (genetlink.Family, error) {
+	return (&fakeGenetlinkConn{c.m.kernel(0)}).GetFamily(name)
+}
+
+func (c multiConn) Execute(msg genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	return c.conn(msg).Execute(msg, family, flags)
+}
+
+func (c multiConn) Send(msg genetlink.Message, family uint16, flags netlink.HeaderFlags) (netlink.Message, error) {
+	return c.conn(msg).Send(msg, family, flags)
+}
+
+func (c multiConn) Close() error {
+	return nil
+}
+
+// deviceConn returns the kernel's end of the connection to the device with
+// the given index.
+func deviceConn(t *testing.T, mk *multiKernel, s *NbdServer, index int) *testConn {
+	t.Helper()
+	f, err := mk.kernel(index).kernelSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, s: s, conn: conn}
+}
+
+func TestManager(t *testing.T) {
+	mk := newMultiKernel(3)
+	// nbd1 is used by another process.
+	mk.kernel(1).setFile("/sys/block/nbd1/pid", "1\n")
+	m, err := newManager(mk, ManagerOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devs := make(map[string]*memDevice)
+	create := func(name string) (*NbdServer, error) {
+		devs[name] = newMemDevice(1 << 20)
+		return m.Create(name, devs[name], 1<<20, BlockDeviceOptions{})
+	}
+	a, err := create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := create("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.name != "/dev/nbd0" || b.name != "/dev/nbd2" {
+		t.Errorf("created %s and %s, want /dev/nbd0 and /dev/nbd2", a.name, b.name)
+	}
+	if _, err := create("c"); err != ErrNoFreeDevice {
+		t.Errorf("Create with no free devices returned %v, want ErrNoFreeDevice", err)
+	}
+	if _, err := m.Create("a", newMemDevice(4096), 4096, BlockDeviceOptions{}); err == nil {
+		t.Error("created a device with a name in use")
+	}
+	if _, err := m.Attach("x", 0, newMemDevice(4096), 4096, BlockDeviceOptions{}); err == nil {
+		t.Error("attached to a device in use")
+	}
+	if names := fmt.Sprint(m.Names()); names != "[a b]" {
+		t.Errorf("got names %s, want [a b]", names)
+	}
+	if m.Device("a") != a || m.Device("x") != nil {
+		t.Error("Device returned the wrong servers")
+	}
+
+	ca, cb := deviceConn(t, mk, a, 0), deviceConn(t, mk, b, 2)
+	ca.write(1, 0, pattern(4096, 1))
+	cb.write(1, 0, pattern(4096, 2))
+	cb.read(2, 0, 8192)
+	st := m.Stats()
+	if st["a"].BytesWritten != 4096 || st["b"].BytesRead != 8192 {
+		t.Errorf("got stats %+v", st)
+	}
+	rec := httptest.NewRecorder()
+	m.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`nbd_written_bytes_total{device="a"} 4096`, `nbd_read_bytes_total{device="b"} 8192`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+
+	if err := m.Detach("a"); err != nil {
+		t.Errorf("Detach: %v", err)
+	}
+	if err := m.Detach("a"); err == nil {
+		t.Error("detached a device twice")
+	}
+	if string(devs["a"].data[:4096]) != string(pattern(4096, 1)) {
+		t.Error("write to a wasn't performed on its device")
+	}
+	if names := fmt.Sprint(m.Names()); names != "[b]" {
+		t.Errorf("got names %s after Detach, want [b]", names)
+	}
+
+	m.Shutdown()
+	if names := m.Names(); len(names) != 0 {
+		t.Errorf("got devices %v after Shutdown", names)
+	}
+	if _, err := create("d"); err != ErrManagerClosed {
+		t.Errorf("Create after Shutdown returned %v, want ErrManagerClosed", err)
+	}
+}
+
+func TestManagerBudgets(t *testing.T) {
+	const n = 32
+	mk := newMultiKernel(2)
+	m, err := newManager(mk, ManagerOptions{MaxWorkers: 3, MaxInFlightBytes: 1 << 20, Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []*NbdServer
+	var devs []*slowDevice
+	for i, name := range []string{"a", "b"} {
+		dev := &slowDevice{memDevice: newMemDevice(1 << 20), delay: 5 * time.Millisecond}
+		s, err := m.Attach(name, i, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 4, MaxInFlightBytes: 1 << 30})
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+		devs = append(devs, dev)
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		c := deviceConn(t, mk, s, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := 0; h < n; h++ {
+				c.send(nbdCmdRead, uint64(h), uint64(h)*4096, 4096, nil)
+			}
+			for h := 0; h < n; h++ {
+				if code, _, _ := c.reply(4096); code != 0 {
+					t.Errorf("read failed with %d", code)
+				}
+			}
+		}()
+	}
+	// Both devices make progress, and share the budget between them, except
+	// that the first worker of each device is exempt.
+	const maxWorkers = 3 + 1
+	for i := 0; i < 10; i++ {
+		if w := servers[0].Workers() + servers[1].Workers(); w > maxWorkers {
+			t.Errorf("got %d workers, want at most %d", w, maxWorkers)
+		}
+		// Each device counts its own bytes against the shared limit.
+		stats := m.Stats()
+		a, b := stats["a"].Buffers, stats["b"].Buffers
+		if a.MaxInFlightBytes != 1<<20 || b.MaxInFlightBytes != 1<<20 || a.InFlightBytes+b.InFlightBytes > 1<<20 {
+			t.Errorf("got %d and %d bytes in flight with limits %d and %d, want within the manager's limit",
+				a.InFlightBytes, b.InFlightBytes, a.MaxInFlightBytes, b.MaxInFlightBytes)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	if a, b := devs[0].maxActive.Load(), devs[1].maxActive.Load(); a == 0 || b == 0 || a+b > maxWorkers {
+		t.Errorf("performed up to %d and %d reads concurrently, want at most %d", a, b, maxWorkers)
+	}
+
+	m.Shutdown()
+	if used := m.workers.used.Load(); used != 0 {
+		t.Errorf("%d workers still counted after Shutdown", used)
+	}
+}
+
+func TestManagerShutdownWhileConnecting(t *testing.T) {
+	mk := newMultiKernel(1)
+	gate := make(chan struct{})
+	mk.kernel(0).connectGate = gate
+	m, err := newManager(mk, ManagerOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Create("a", newMemDevice(1<<20), 1<<20, BlockDeviceOptions{})
+	waitFor(t, "the device to be added", func() bool { return len(m.Names()) == 1 })
+
+	// Shutdown waits for the device to connect before disconnecting it, since
+	// disconnecting earlier has no effect.
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	waitFor(t, "Shutdown to start", func() bool {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.closed
+	})
+	close(gate)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown didn't return")
+	}
+	if reqs := mk.kernel(0).netlinkRequests(); len(reqs) != 2 || reqs[1].cmd != nbdNlCmdDisconnect {
+		t.Errorf("got netlink requests %+v, want connect and disconnect", reqs)
+	}
+}
+
+func TestManagerStartFails(t *testing.T) {
+	// Without netlink, devices are started with NBD_DO_IT.
+	k := newFakeKernel(0)
+	k.doItErr = unix.EBUSY
+	m, err := newManager(k, ManagerOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown()
+
+	if _, err := m.Attach("a", 0, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{}); err != unix.EBUSY {
+		t.Errorf("Attach returned %v, want EBUSY", err)
+	}
+	if s := m.Device("a"); s != nil {
+		t.Error("device which failed to start exists")
+	}
+}
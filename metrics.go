@@ -0,0 +1,362 @@
+package nbd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of request latency
+// histograms.
+var LatencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Error codes which may be sent in replies.
+var nbdErrorCodes = [...]uint32{nbdEperm, nbdEio, nbdEnomem, nbdEinval, nbdEnospc, nbdEoverflow, nbdEshutdown}
+
+const numCommands = nbdCmdWriteZeroes + 1
+
+// LatencyHistogram is a histogram of request latencies.
+type LatencyHistogram struct {
+	// Counts[i] is the number of requests with a latency no greater than
+	// LatencyBuckets[i], and greater than LatencyBuckets[i-1]. The final
+	// element counts requests slower than every bucket.
+	Counts []uint64
+	// Sum is the total latency of all requests.
+	Sum time.Duration
+}
+
+// OpStats are statistics about requests with a single command.
+type OpStats struct {
+	Requests uint64
+	Errors   uint64
+	// Bytes is the total length of the requests.
+	Bytes   uint64
+	Latency LatencyHistogram
+}
+
+// Stats is a snapshot of a NbdServer's statistics.
+type Stats struct {
+	// Ops contains statistics for each command which has been received.
+	Ops map[Command]OpStats
+
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// Errors counts error replies by NBD error code.
+	Errors map[uint32]uint64
+
+	// InFlight is the number of requests received which haven't completed.
+	InFlight int64
+	// QueueDepth is the number of requests waiting for a worker.
+	QueueDepth int
+	// Workers is the number of worker goroutines.
+	Workers int
+	// Panics counts panics recovered from the block device.
+	Panics uint64
+	// Failures counts requests failed by the block device, with coalesced
+	// writes counted once, which are compared against ErrorThreshold.
+	Failures uint64
+	// Degraded is true if writes are refused after ErrorThreshold failures.
+	Degraded bool
+	// Throttled counts requests delayed by the rate limits, and ThrottledTime
+	// is the total time they were delayed for.
+	Throttled     uint64
+	ThrottledTime time.Duration
+	// RateLimits are the current rate limits.
+	RateLimits RateLimits
+	// Paused is true if requests are paused by Pause.
+	Paused bool
+	// DuplicateHandles counts requests received with the same handle as an
+	// in-flight request.
+	DuplicateHandles uint64
+	// ReadAheadHits and ReadAheadMisses count reads which were and weren't
+	// served from prefetched data, while read-ahead is enabled.
+	ReadAheadHits   uint64
+	ReadAheadMisses uint64
+
+	Buffers BufferStats
+}
+
+type opMetrics struct {
+	requests   atomic.Uint64
+	errors     atomic.Uint64
+	bytes      atomic.Uint64
+	latency    [len(LatencyBuckets) + 1]atomic.Uint64
+	latencySum atomic.Int64
+}
+
+type serverMetrics struct {
+	ops      [numCommands]opMetrics
+	errors   [len(nbdErrorCodes)]atomic.Uint64
+	inFlight atomic.Int64
+	panics   atomic.Uint64
+
+	readAheadHits   atomic.Uint64
+	readAheadMisses atomic.Uint64
+}
+
+func (m *serverMetrics) received() {
+	m.inFlight.Add(1)
+}
+
+func (m *serverMetrics) completed(req *Request, code uint32, latency time.Duration) {
+	m.inFlight.Add(-1)
+	if code != 0 {
+		for i, c := range nbdErrorCodes {
+			if c == code {
+				m.errors[i].Add(1)
+			}
+		}
+	}
+	if int(req.cmd) >= len(m.ops) {
+		return
+	}
+	op := &m.ops[req.cmd]
+	op.requests.Add(1)
+	if code != 0 {
+		op.errors.Add(1)
+	}
+	op.bytes.Add(uint64(req.length))
+	bucket := sort.Search(len(LatencyBuckets), func(i int) bool {
+		return latency <= LatencyBuckets[i]
+	})
+	op.latency[bucket].Add(1)
+	op.latencySum.Add(int64(latency))
+}
+
+func (m *serverMetrics) stats(st *Stats) {
+	st.Ops = make(map[Command]OpStats)
+	for i := range m.ops {
+		op := &m.ops[i]
+		opStats := OpStats{
+			Requests: op.requests.Load(),
+			Errors:   op.errors.Load(),
+			Bytes:    op.bytes.Load(),
+			Latency: LatencyHistogram{
+				Counts: make([]uint64, len(op.latency)),
+				Sum:    time.Duration(op.latencySum.Load()),
+			},
+		}
+		if opStats.Requests == 0 {
+			continue
+		}
+		for j := range op.latency {
+			opStats.Latency.Counts[j] = op.latency[j].Load()
+		}
+		st.Ops[Command(i)] = opStats
+	}
+	st.BytesRead = st.Ops[CmdRead].Bytes
+	st.BytesWritten = st.Ops[CmdWrite].Bytes
+
+	st.Errors = make(map[uint32]uint64)
+	for i := range m.errors {
+		if n := m.errors[i].Load(); n > 0 {
+			st.Errors[nbdErrorCodes[i]] = n
+		}
+	}
+	st.InFlight = m.inFlight.Load()
+	st.Panics = m.panics.Load()
+	st.ReadAheadHits = m.readAheadHits.Load()
+	st.ReadAheadMisses = m.readAheadMisses.Load()
+}
+
+// Stats returns a snapshot of the server's statistics.
+func (s *NbdServer) Stats() Stats {
+	var st Stats
+	s.metrics.stats(&st)
+	if p := s.workers.Load(); p != nil {
+		st.QueueDepth = len(p.reqCh)
+	}
+	st.Workers = s.Workers()
+	st.Failures = uint64(s.failures.Load())
+	st.Degraded = s.degraded.Load()
+	st.Paused = s.Paused()
+	st.Throttled = s.limiter.throttled.Load()
+	st.ThrottledTime = time.Duration(s.limiter.throttledTime.Load())
+	st.RateLimits = s.RateLimits()
+	st.DuplicateHandles = s.inFlight.duplicateHandles()
+	st.Buffers = s.BufferStats()
+	return st
+}
+
+// MetricsHandler returns an http.Handler which serves the server's Stats in
+// the Prometheus text exposition format.
+func (s *NbdServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, map[string]Stats{s.name: s.Stats()})
+	})
+}
+
+// writeMetrics writes the stats of each device, keyed by device name, in the
+// Prometheus text exposition format.
+func writeMetrics(w io.Writer, devices map[string]Stats) error {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string, each func(dev string, st *Stats)) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, dev := range names {
+			st := devices[dev]
+			each(dev, &st)
+		}
+	}
+	value := func(name, labels string, v any) {
+		fmt.Fprintf(bw, "%s{%s} %v\n", name, labels, v)
+	}
+	opLabels := func(dev string, cmd Command) string {
+		return fmt.Sprintf("device=%s,op=%s", labelValue(dev), labelValue(cmd.String()))
+	}
+
+	metric("nbd_requests_total", "counter", "Requests completed, by operation.", func(dev string, st *Stats) {
+		for cmd := Command(0); cmd < numCommands; cmd++ {
+			if op, ok := st.Ops[cmd]; ok {
+				value("nbd_requests_total", opLabels(dev, cmd), op.Requests)
+			}
+		}
+	})
+	metric("nbd_request_errors_total", "counter", "Requests which failed, by operation.", func(dev string, st *Stats) {
+		for cmd := Command(0); cmd < numCommands; cmd++ {
+			if op, ok := st.Ops[cmd]; ok {
+				value("nbd_request_errors_total", opLabels(dev, cmd), op.Errors)
+			}
+		}
+	})
+	metric("nbd_request_bytes_total", "counter", "Total length of requests, by operation.", func(dev string, st *Stats) {
+		for cmd := Command(0); cmd < numCommands; cmd++ {
+			if op, ok := st.Ops[cmd]; ok {
+				value("nbd_request_bytes_total", opLabels(dev, cmd), op.Bytes)
+			}
+		}
+	})
+	metric("nbd_errors_total", "counter", "Error replies, by NBD error code.", func(dev string, st *Stats) {
+		codes := make([]int, 0, len(st.Errors))
+		for code := range st.Errors {
+			codes = append(codes, int(code))
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			value("nbd_errors_total", fmt.Sprintf("device=%s,code=\"%d\"", labelValue(dev), code), st.Errors[uint32(code)])
+		}
+	})
+	metric("nbd_read_bytes_total", "counter", "Bytes read.", func(dev string, st *Stats) {
+		value("nbd_read_bytes_total", "device="+labelValue(dev), st.BytesRead)
+	})
+	metric("nbd_written_bytes_total", "counter", "Bytes written.", func(dev string, st *Stats) {
+		value("nbd_written_bytes_total", "device="+labelValue(dev), st.BytesWritten)
+	})
+	metric("nbd_in_flight_requests", "gauge", "Requests received which haven't completed.", func(dev string, st *Stats) {
+		value("nbd_in_flight_requests", "device="+labelValue(dev), st.InFlight)
+	})
+	metric("nbd_queue_depth", "gauge", "Requests waiting for a worker.", func(dev string, st *Stats) {
+		value("nbd_queue_depth", "device="+labelValue(dev), st.QueueDepth)
+	})
+	metric("nbd_workers", "gauge", "Worker goroutines.", func(dev string, st *Stats) {
+		value("nbd_workers", "device="+labelValue(dev), st.Workers)
+	})
+	metric("nbd_panics_total", "counter", "Panics recovered from the block device.", func(dev string, st *Stats) {
+		value("nbd_panics_total", "device="+labelValue(dev), st.Panics)
+	})
+	metric("nbd_failures_total", "counter", "Requests failed by the block device, counted towards the error threshold.", func(dev string, st *Stats) {
+		value("nbd_failures_total", "device="+labelValue(dev), st.Failures)
+	})
+	metric("nbd_degraded", "gauge", "Whether writes are refused due to errors.", func(dev string, st *Stats) {
+		degraded := 0
+		if st.Degraded {
+			degraded = 1
+		}
+		value("nbd_degraded", "device="+labelValue(dev), degraded)
+	})
+	metric("nbd_throttled_requests_total", "counter", "Requests delayed by rate limits.", func(dev string, st *Stats) {
+		value("nbd_throttled_requests_total", "device="+labelValue(dev), st.Throttled)
+	})
+	metric("nbd_throttled_seconds_total", "counter", "Total time requests were delayed by rate limits.", func(dev string, st *Stats) {
+		value("nbd_throttled_seconds_total", "device="+labelValue(dev), st.ThrottledTime.Seconds())
+	})
+	metric("nbd_rate_limit", "gauge", "Rate limits, or 0 if unlimited.", func(dev string, st *Stats) {
+		l := &st.RateLimits
+		value("nbd_rate_limit", fmt.Sprintf("device=%s,limit=\"read_iops\"", labelValue(dev)), l.ReadIOPS)
+		value("nbd_rate_limit", fmt.Sprintf("device=%s,limit=\"write_iops\"", labelValue(dev)), l.WriteIOPS)
+		value("nbd_rate_limit", fmt.Sprintf("device=%s,limit=\"read_bytes_per_second\"", labelValue(dev)), l.ReadBytesPerSec)
+		value("nbd_rate_limit", fmt.Sprintf("device=%s,limit=\"write_bytes_per_second\"", labelValue(dev)), l.WriteBytesPerSec)
+	})
+	metric("nbd_paused", "gauge", "Whether requests are paused.", func(dev string, st *Stats) {
+		paused := 0
+		if st.Paused {
+			paused = 1
+		}
+		value("nbd_paused", "device="+labelValue(dev), paused)
+	})
+	metric("nbd_duplicate_handles_total", "counter", "Requests received with the handle of an in-flight request.", func(dev string, st *Stats) {
+		value("nbd_duplicate_handles_total", "device="+labelValue(dev), st.DuplicateHandles)
+	})
+	metric("nbd_read_ahead_hits_total", "counter", "Reads served from prefetched data.", func(dev string, st *Stats) {
+		value("nbd_read_ahead_hits_total", "device="+labelValue(dev), st.ReadAheadHits)
+	})
+	metric("nbd_read_ahead_misses_total", "counter", "Reads which weren't served from prefetched data.", func(dev string, st *Stats) {
+		value("nbd_read_ahead_misses_total", "device="+labelValue(dev), st.ReadAheadMisses)
+	})
+	metric("nbd_buffer_pool_hits_total", "counter", "Buffers reused from the pool.", func(dev string, st *Stats) {
+		value("nbd_buffer_pool_hits_total", "device="+labelValue(dev), st.Buffers.PoolHits)
+	})
+	metric("nbd_buffer_pool_allocs_total", "counter", "Buffers allocated.", func(dev string, st *Stats) {
+		value("nbd_buffer_pool_allocs_total", "device="+labelValue(dev), st.Buffers.PoolAllocs)
+	})
+	metric("nbd_in_flight_bytes", "gauge", "Request and reply data bytes in use.", func(dev string, st *Stats) {
+		value("nbd_in_flight_bytes", "device="+labelValue(dev), st.Buffers.InFlightBytes)
+	})
+	metric("nbd_request_duration_seconds", "histogram", "Request latency, by operation.", func(dev string, st *Stats) {
+		for cmd := Command(0); cmd < numCommands; cmd++ {
+			op, ok := st.Ops[cmd]
+			if !ok {
+				continue
+			}
+			labels := opLabels(dev, cmd)
+			var cumulative uint64
+			for i, bound := range LatencyBuckets {
+				cumulative += op.Latency.Counts[i]
+				value("nbd_request_duration_seconds_bucket", fmt.Sprintf("%s,le=\"%g\"", labels, bound.Seconds()), cumulative)
+			}
+			cumulative += op.Latency.Counts[len(LatencyBuckets)]
+			value("nbd_request_duration_seconds_bucket", labels+`,le="+Inf"`, cumulative)
+			value("nbd_request_duration_seconds_sum", labels, op.Latency.Sum.Seconds())
+			value("nbd_request_duration_seconds_count", labels, cumulative)
+		}
+	})
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes v as a label value in the Prometheus text exposition
+// format, in which only backslash, double quote and line feed are escaped.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,87 @@
+package nbd
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// failingDevice fails writes at offset 0 with err.
+type failingDevice struct {
+	*memDevice
+	err error
+}
+
+func (d *failingDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off == 0 {
+		return 0, d.err
+	}
+	return d.memDevice.WriteAt(b, off)
+}
+
+func TestErrorRepliesAndMetrics(t *testing.T) {
+	dev := &failingDevice{memDevice: newMemDevice(1 << 20), err: syscall.ENOSPC}
+	// The device doesn't support trim.
+	s, k := newTestServer(t, struct{ BlockDevice }{dev}, 1<<20, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+
+	c.write(1, 4096, pattern(4096, 1))
+	c.read(2, 4096, 4096)
+	// Every failure is reported to the kernel as EIO.
+	c.send(nbdCmdWrite, 3, 0, 4096, pattern(4096, 1))
+	if code, _, _ := c.reply(0); code != nbdEio {
+		t.Errorf("failed write replied with %d, want EIO", code)
+	}
+	c.send(nbdCmdTrim, 4, 0, 4096, nil)
+	if code, _, _ := c.reply(0); code != nbdEio {
+		t.Errorf("unsupported trim replied with %d, want EIO", code)
+	}
+
+	st := s.Stats()
+	if st.BytesRead != 4096 || st.BytesWritten != 8192 {
+		t.Errorf("got %d bytes read and %d written, want 4096 and 8192", st.BytesRead, st.BytesWritten)
+	}
+	if w := st.Ops[CmdWrite]; w.Requests != 2 || w.Errors != 1 {
+		t.Errorf("got %d writes and %d errors, want 2 and 1", w.Requests, w.Errors)
+	}
+	if len(st.Errors) != 1 || st.Errors[nbdEio] != 2 {
+		t.Errorf("got errors %v, want 2 EIO", st.Errors)
+	}
+	if st.InFlight != 0 {
+		t.Errorf("got %d requests in flight, want 0", st.InFlight)
+	}
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`nbd_requests_total{device="/dev/nbd0",op="Write"} 2`,
+		`nbd_request_errors_total{device="/dev/nbd0",op="Write"} 1`,
+		`nbd_errors_total{device="/dev/nbd0",code="5"} 2`,
+		`nbd_read_bytes_total{device="/dev/nbd0"} 4096`,
+		`nbd_request_duration_seconds_count{device="/dev/nbd0",op="Read"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	var b strings.Builder
+	name := "a\\b\"c\nd\te"
+	if err := writeMetrics(&b, map[string]Stats{name: {Workers: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Only backslash, double quote and line feed are escaped, unlike with Go
+	// quoting.
+	want := `nbd_workers{device="a\\b\"c\nd` + "\t" + `e"} 1`
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("metrics don't contain %s:\n%s", want, b.String())
+	}
+}
@@ -0,0 +1,111 @@
+package nbd
+
+import (
+	"io"
+)
+
+// Op is a single operation on a block device, as passed to a Handler.
+type Op struct {
+	Command Command
+	Flags   uint16
+
+	// Handle of the request. If adjacent writes were coalesced, this is the
+	// handle of the first.
+	Handle uint64
+
+	Offset int64
+	Length uint32
+
+	// Data is the buffer to read into for reads, and the data to be written for
+	// writes. It is nil for other commands, and must not be used after the
+	// operation has been completed.
+	Data []byte
+}
+
+// Handler performs operations on a block device.
+type Handler interface {
+	Handle(op Op) error
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(op Op) error
+
+func (f HandlerFunc) Handle(op Op) error {
+	return f(op)
+}
+
+// Middleware wraps a Handler, to add behaviour before or after operations are
+// passed on to next, or to handle them itself. Operations which aren't
+// supported should return ErrUnsupported.
+type Middleware func(next Handler) Handler
+
+// Chain combines middleware into one. The first middleware is the outermost,
+// and sees each operation first.
+func Chain(mw ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
+
+// DeviceHandler returns a Handler which performs operations on dev. Flush and
+// Trim return ErrUnsupported if dev doesn't implement BlockDeviceFlusher and
+// BlockDeviceTrimer respectively.
+func DeviceHandler(dev BlockDevice) Handler {
+	return HandlerFunc(func(op Op) error {
+		return handleOp(dev, op)
+	})
+}
+
+func handleOp(dev BlockDevice, op Op) error {
+	switch op.Command {
+	case CmdRead:
+		n, err := dev.ReadAt(op.Data, op.Offset)
+		if err == io.EOF && n == len(op.Data) {
+			// io.ReaderAt is allowed to return EOF on a complete read, which should
+			// not be treated an an error.
+			err = nil
+		}
+		return err
+	case CmdWrite:
+		_, err := dev.WriteAt(op.Data, op.Offset)
+		return err
+	case CmdFlush:
+		if f, ok := dev.(BlockDeviceFlusher); ok {
+			return f.Flush()
+		}
+	case CmdTrim:
+		if t, ok := dev.(BlockDeviceTrimer); ok {
+			return t.Trim(op.Offset, op.Length)
+		}
+	}
+	return ErrUnsupported
+}
+
+// newHandler returns the handler requests are passed to: the middleware in
+// the options, around the block device.
+func (s *NbdServer) newHandler() Handler {
+	var h Handler = HandlerFunc(s.handle)
+	if len(s.opts.Middleware) > 0 {
+		h = Chain(s.opts.Middleware...)(h)
+	}
+	return h
+}
+
+// handle performs op on the block device, using prefetched data where
+// possible.
+func (s *NbdServer) handle(op Op) error {
+	switch op.Command {
+	case CmdRead:
+		if s.ra.read(op.Data, uint64(op.Offset)) {
+			return nil
+		}
+	case CmdWrite, CmdTrim:
+		// Prefetches which started before the write completed might contain old
+		// data.
+		defer s.ra.invalidate(uint64(op.Offset), op.Length)
+	}
+	return handleOp(s.block, op)
+}
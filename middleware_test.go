@@ -0,0 +1,91 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// xorMiddleware inverts data on its way to and from the device.
+func xorMiddleware(next Handler) Handler {
+	return HandlerFunc(func(op Op) error {
+		if op.Command == CmdWrite {
+			data := make([]byte, len(op.Data))
+			for i, b := range op.Data {
+				data[i] = ^b
+			}
+			op.Data = data
+		}
+		err := next.Handle(op)
+		if op.Command == CmdRead && err == nil {
+			for i := range op.Data {
+				op.Data[i] = ^op.Data[i]
+			}
+		}
+		return err
+	})
+}
+
+func TestChain(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(op Op) error {
+				lock.Lock()
+				calls = append(calls, name)
+				lock.Unlock()
+				return next.Handle(op)
+			})
+		}
+	}
+	h := Chain(trace("outer"), trace("inner"))(DeviceHandler(newMemDevice(4096)))
+	if err := h.Handle(Op{Command: CmdFlush}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(calls) != "[outer inner]" {
+		t.Errorf("got calls %v, want [outer inner]", calls)
+	}
+	if err := DeviceHandler(struct{ BlockDevice }{newMemDevice(4096)}).Handle(Op{Command: CmdTrim}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("trim without a trimmer returned %v, want ErrUnsupported", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	dev := newMemDevice(1 << 20)
+	refuseTrim := func(next Handler) Handler {
+		return HandlerFunc(func(op Op) error {
+			if op.Command == CmdTrim {
+				return ErrUnsupported
+			}
+			return next.Handle(op)
+		})
+	}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		Middleware: []Middleware{refuseTrim, xorMiddleware},
+	})
+	c := startServer(t, s, k)
+
+	data := pattern(8192, 9)
+	c.write(1, 0, data)
+	if got := c.read(2, 0, 8192); string(got) != string(data) {
+		t.Error("read through the middleware returned the wrong data")
+	}
+	c.send(nbdCmdTrim, 3, 0, 4096, nil)
+	if code, _, _ := c.reply(0); code != nbdEio {
+		t.Errorf("refused trim replied with %d, want EIO", code)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	for i, b := range dev.data[:8192] {
+		if b != ^data[i] {
+			t.Fatal("the device wasn't written through the middleware")
+		}
+	}
+	if dev.trims != 0 {
+		t.Error("refused trim reached the device")
+	}
+}
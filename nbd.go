@@ -6,10 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/bits"
+	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
@@ -39,10 +44,28 @@ type BlockDeviceTrimer interface {
 	Trim(off int64, length uint32) error
 }
 
+// BlockDeviceFlusher is implemented by block devices which support flushing
+// written data to stable storage. A write's reply is only sent once the write
+// has been performed, so a Flush covers every write the kernel has seen
+// complete. See BlockDeviceOptions.FlushBarrier for stronger ordering.
 type BlockDeviceFlusher interface {
 	Flush() error
 }
 
+// DeviceCharacteristics describes the physical characteristics of a block
+// device, which the kernel uses to tune I/O scheduling.
+type DeviceCharacteristics struct {
+	// Rotational should be set to true if the device is backed by media with
+	// a seek penalty, such as hard disks.
+	Rotational bool
+}
+
+// BlockDeviceCharacterizer can be implemented by a BlockDevice to advertise
+// its characteristics. These are combined with those in BlockDeviceOptions.
+type BlockDeviceCharacterizer interface {
+	Characteristics() DeviceCharacteristics
+}
+
 type BlockDeviceOptions struct {
 	// BlockSize is the size of each block on the block device, in bytes.
 	// Must be between 512 and the system page size (usually 4096 on x86).
@@ -54,8 +77,112 @@ type BlockDeviceOptions struct {
 	// If 0, the default value of DefaultConcurrentOps will be used.
 	ConcurrentOps int
 
+	// MinConcurrentOps, if non-zero, makes the number of concurrent operations
+	// adaptive. Workers are added, up to ConcurrentOps, while requests are
+	// queued and the backend is slow enough to benefit, and removed down to
+	// MinConcurrentOps after being idle for WorkerIdleTimeout. Must be between
+	// 1 and ConcurrentOps.
+	MinConcurrentOps int
+
+	// WorkerIdleTimeout is how long a worker must be idle before it is
+	// removed. If 0, DefaultWorkerIdleTimeout is used.
+	WorkerIdleTimeout time.Duration
+
+	// OrderOverlapping, if true, performs requests with overlapping ranges in
+	// the order they were received, where at least one of them modifies the
+	// range. Non-overlapping requests are still performed concurrently. This
+	// is needed for block devices which don't order concurrent operations.
+	OrderOverlapping bool
+
+	// FlushBarrier, if true, makes a flush a full barrier. It is performed
+	// only after every write received before it has completed, and writes
+	// received after it wait for it to complete.
+	FlushBarrier bool
+
+	// MaxCoalesceBytes, if non-zero, enables merging of queued writes to
+	// adjacent ranges into a single WriteAt of up to this many bytes. Not used
+	// with an AsyncBlockDevice.
+	MaxCoalesceBytes int
+
+	// ReadAheadBytes, if non-zero, enables read-ahead. Once sequential reads
+	// are detected, up to this many bytes following them are prefetched,
+	// unless reads are being throttled by RateLimits. Not used with an
+	// AsyncBlockDevice or BlockDeviceFd.
+	ReadAheadBytes int
+
+	// ReadAheadCacheBytes limits the size of prefetched data held in memory.
+	// If smaller than twice ReadAheadBytes, twice ReadAheadBytes is used.
+	ReadAheadCacheBytes int
+
 	// Readonly should be set to true if the block device is read-only.
 	Readonly bool
+
+	// RateLimits limits the rate at which requests are performed. They can be
+	// changed while running with SetRateLimits. With OrderOverlapping or
+	// FlushBarrier, requests are dispatched in the order they are received, so
+	// a throttled request also holds up the requests after it.
+	RateLimits RateLimits
+
+	// MaxPause is the longest time requests can be paused by Pause before they
+	// are resumed automatically. If 0, DefaultMaxPause is used.
+	MaxPause time.Duration
+
+	// ErrorThreshold, if non-zero, is the number of requests the block device
+	// can fail, by returning an error or panicking, before ErrorAction is
+	// taken. Coalesced writes count as a single request. Panics are always
+	// recovered, and the request fails with EIO.
+	ErrorThreshold int
+
+	// ErrorAction is taken once ErrorThreshold requests have failed.
+	ErrorAction ErrorAction
+
+	// Middleware, if set, is wrapped around the block device, with the first
+	// middleware seeing each operation first. Requests are passed through it
+	// with their data in memory, so an AsyncBlockDevice is used synchronously
+	// and data isn't spliced to or from a BlockDeviceFd.
+	Middleware []Middleware
+
+	// OnEvent, if set, is called with each change in the lifecycle of the
+	// device. It is called synchronously, so should return quickly.
+	OnEvent func(ev Event)
+
+	// Observer, if set, is notified as each request passes through the
+	// server.
+	Observer Observer
+
+	// Logger is used to log server events. Per-request events, such as I/O
+	// errors, are logged at slog.LevelDebug. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// DeviceCharacteristics of the block device.
+	DeviceCharacteristics
+
+	// DisconnectOnClose, if true, disconnects the device when the last opener
+	// of /dev/nbdX closes it. Only supported when using netlink. NewServer and
+	// NewServerFromFd return an error if it is set, and NewServerAuto ignores
+	// it with a warning if netlink is unavailable.
+	DisconnectOnClose bool
+
+	// BackendIdentifier is an optional string identifying the backend of the
+	// block device, which the kernel shows in /sys/block/nbdX/backend. Only
+	// supported when using netlink, like DisconnectOnClose, and ignored by
+	// kernels before 5.19.
+	BackendIdentifier string
+
+	// DropPrivileges, if set, is called by Run once the kernel has been set
+	// up, after which the server needs no privileges, such as to switch to an
+	// unprivileged user with Privileges.Drop. Requests continue on the already
+	// connected socket. Once privileges have been dropped, Disconnect can't ask
+	// the kernel to disconnect, so shuts down the connection instead. If
+	// DropPrivileges returns an error, the device is disconnected, and Run
+	// returns the error. With ioctls, the device's sysfs directory must be
+	// known, as it is used to tell when the device has started.
+	DropPrivileges func() error
+
+	// MaxInFlightBytes limits the total size of request and reply data buffers
+	// in use at any time. When the limit is reached, no more requests are
+	// received until replies have been sent. If 0, memory use is unlimited.
+	MaxInFlightBytes int64
 }
 
 type NbdServer struct {
@@ -64,11 +191,77 @@ type NbdServer struct {
 	devFd  int
 	sockfd int
 	block  BlockDevice
+	kc     kernelControl
+	logger *slog.Logger
+
+	// Held while the block device is changed. The block device, and the state
+	// below derived from it, is only changed while requests are quiesced.
+	backendLock sync.Mutex
+	// Set if requests are submitted to an AsyncBlockDevice.
+	async AsyncBlockDevice
+	// Set while running if data can be spliced to and from the block device.
+	sp *splicer
+	// Prefetches sequential reads, if enabled.
+	ra *readAhead
+	// The kernel socket, while running.
+	sock syscall.RawConn
+
+	quiesce *quiescer
+
+	// Set while paused by Pause, to resume after MaxPause. pauseGen counts
+	// pauses, so that the timer only resumes the pause it was started for.
+	// pauseCancel is set while Pause is waiting for the pause to take effect.
+	pauseLock   sync.Mutex
+	pauseTimer  *time.Timer
+	pauseGen    uint64
+	pauseCancel context.CancelCauseFunc
+
+	// Handles requests, through any middleware.
+	handler Handler
 
 	// Netlink stuff
 	nlConn *NetlinkConn
 	index  int
 
+	reqPool   RequestPool
+	replyPool ReplyPool
+	bufLimit  *memLimiter
+
+	numWorkers atomic.Int32
+	workers    atomic.Pointer[workerPool]
+	// Shared with the other devices of a Manager, if any.
+	workerBudget *workerBudget
+
+	// Sysfs directory of the device, if known.
+	sysfs string
+
+	// Name of the device, used in metrics.
+	name    string
+	metrics serverMetrics
+
+	// Orders overlapping requests, if enabled.
+	ranges *rangeLocker
+
+	inFlight inFlightTracker
+	limiter  rateLimiter
+
+	// Requests failed by the block device, and whether writes are refused as a
+	// result.
+	failures atomic.Int64
+	degraded atomic.Bool
+	// Set if the device is disconnected due to errors.
+	errorDisconnect atomic.Bool
+
+	// Set once privileges have been dropped, and if the connection has been
+	// shut down by Disconnect as a result.
+	privDropped atomic.Bool
+	shutdown    atomic.Bool
+
+	// Ensures EventConnected is sent at most once.
+	connectOnce sync.Once
+	// Set if NBD_DO_IT failed, which ends the connection.
+	startErr atomic.Pointer[error]
+
 	doneCh chan bool
 }
 
@@ -91,33 +284,102 @@ func validateOptions(opts *BlockDeviceOptions, size int64) error {
 	} else if opts.ConcurrentOps < 0 || opts.ConcurrentOps > MaxConcurrentOps {
 		return fmt.Errorf("nbd: ConcurrentOps must be between 1 and %d", MaxConcurrentOps)
 	}
+	if opts.MinConcurrentOps < 0 || opts.MinConcurrentOps > opts.ConcurrentOps {
+		return errors.New("nbd: MinConcurrentOps must be between 1 and ConcurrentOps")
+	}
+	if opts.MaxCoalesceBytes < 0 || opts.ReadAheadBytes < 0 || opts.ReadAheadCacheBytes < 0 {
+		return errors.New("nbd: coalescing and read-ahead sizes must be non-negative")
+	}
+	if opts.WorkerIdleTimeout < 0 {
+		return errors.New("nbd: WorkerIdleTimeout must be non-negative")
+	}
+
+	if err := opts.RateLimits.validate(); err != nil {
+		return err
+	}
+	if opts.MaxPause < 0 {
+		return errors.New("nbd: MaxPause must be non-negative")
+	}
+	if opts.ErrorThreshold < 0 {
+		return errors.New("nbd: ErrorThreshold must be non-negative")
+	}
+	if opts.ErrorAction < ErrorsContinue || opts.ErrorAction > ErrorsDisconnect {
+		return errors.New("nbd: invalid ErrorAction")
+	}
+
+	if opts.MaxInFlightBytes < 0 {
+		return errors.New("nbd: MaxInFlightBytes must be non-negative")
+	}
 
 	return nil
 }
 
+func newNbdServer(kc kernelControl, block BlockDevice, size int64, opts BlockDeviceOptions) *NbdServer {
+	limit := newMemLimiter(opts.MaxInFlightBytes)
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &NbdServer{
+		logger:    logger,
+		opts:      opts,
+		size:      size,
+		devFd:     -1,
+		block:     block,
+		kc:        kc,
+		reqPool:   RequestPool{bufs: newBufferPool(0), limit: limit},
+		replyPool: ReplyPool{bufs: newBufferPool(replyHeaderSize), limit: limit},
+		bufLimit:  limit,
+		quiesce:   newQuiescer(),
+		doneCh:    make(chan bool),
+	}
+	s.handler = s.newHandler()
+	s.limiter.setLimits(opts.RateLimits)
+	return s
+}
+
 func NewServer(dev string, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
 	devFd, err := unix.Open(dev, unix.O_RDWR, 0)
 	if err != nil {
 		return nil, err
 	}
-	return NewServerFromFd(devFd, block, size, opts)
+	s, err := NewServerFromFd(devFd, block, size, opts)
+	if err != nil {
+		unix.Close(devFd)
+		return nil, err
+	}
+	s.name = dev
+	s.logger = s.logger.With("device", dev)
+	return s, nil
 }
 
 func NewServerFromFd(devFd int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	return newServerFromFd(sysKernel{}, devFd, block, size, opts)
+}
+
+func newServerFromFd(kc kernelControl, devFd int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
 	err := validateOptions(&opts, size)
 	if err != nil {
 		return nil, err
 	}
-	return &NbdServer{
-		opts:   opts,
-		size:   size,
-		devFd:  devFd,
-		block:  block,
-		doneCh: make(chan bool),
-	}, nil
+	if names := netlinkOnlyOptions(&opts); len(names) > 0 {
+		return nil, fmt.Errorf("nbd: %s not supported with ioctls", strings.Join(names, " and "))
+	}
+	s := newNbdServer(kc, block, size, opts)
+	s.devFd = devFd
+	s.name = fmt.Sprintf("fd%d", devFd)
+	s.sysfs, err = fdSysfsDir(devFd)
+	if err != nil {
+		s.logger.Warn("nbd: unable to find device in sysfs", "error", err)
+	}
+	return s, nil
 }
 
 func NewServerWithNetlink(index int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	return newServerWithNetlink(sysKernel{}, index, block, size, opts)
+}
+
+func newServerWithNetlink(kc kernelControl, index int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
 	if index < 0 {
 		return nil, errors.New("nbd: index must be non-negative")
 	}
@@ -127,19 +389,114 @@ func NewServerWithNetlink(index int, block BlockDevice, size int64, opts BlockDe
 		return nil, err
 	}
 
-	nl, err := NewNetlinkConn(index)
+	nl, err := newNetlinkConn(kc, index)
 	if err != nil {
 		return nil, err
 	}
+	return newNetlinkServer(kc, nl, index, block, size, opts), nil
+}
 
-	return &NbdServer{
-		opts:   opts,
-		size:   size,
-		block:  block,
-		nlConn: nl,
-		index:  index,
-		doneCh: make(chan bool),
-	}, nil
+// NewServerAuto creates a server for the nbd device with the given index
+// (i.e. /dev/nbd<index>). Netlink is used if the kernel provides a supported
+// version of the "nbd" generic netlink family, otherwise the server falls back
+// to using ioctls on the device. Use Transport to find out which was chosen.
+// With either transport, a single socket is attached to the device, and a
+// connected device can't be reconfigured.
+func NewServerAuto(index int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	return newServerAuto(sysKernel{}, index, block, size, opts)
+}
+
+func newServerAuto(kc kernelControl, index int, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, error) {
+	if index < 0 {
+		return nil, errors.New("nbd: index must be non-negative")
+	}
+
+	err := validateOptions(&opts, size)
+	if err != nil {
+		return nil, err
+	}
+
+	nl, nlErr := newNetlinkConn(kc, index)
+	if nlErr == nil {
+		if nl.Version() >= nbdNlVersion {
+			return newNetlinkServer(kc, nl, index, block, size, opts), nil
+		}
+		nl.Close()
+		nlErr = fmt.Errorf("unsupported netlink version %d", nl.Version())
+	}
+
+	devFd, err := kc.openDevice(DevicePath(index))
+	if err != nil {
+		return nil, fmt.Errorf("nbd: netlink unavailable (%w), and ioctl fallback failed: %w", nlErr, err)
+	}
+	ignored := netlinkOnlyOptions(&opts)
+	opts.DisconnectOnClose = false
+	opts.BackendIdentifier = ""
+	s, err := newServerFromFd(kc, devFd, block, size, opts)
+	if err != nil {
+		unix.Close(devFd)
+		return nil, err
+	}
+	s.name = DevicePath(index)
+	s.logger = s.logger.With("index", index)
+	s.logger.Info("nbd: netlink unavailable, using ioctl", "error", nlErr)
+	if len(ignored) > 0 {
+		s.logger.Warn("nbd: ignoring options not supported with ioctls", "options", ignored)
+	}
+	return s, nil
+}
+
+// netlinkOnlyOptions returns the names of the options set in opts which are
+// only supported when using netlink.
+func netlinkOnlyOptions(opts *BlockDeviceOptions) []string {
+	var names []string
+	if opts.DisconnectOnClose {
+		names = append(names, "DisconnectOnClose")
+	}
+	if opts.BackendIdentifier != "" {
+		names = append(names, "BackendIdentifier")
+	}
+	return names
+}
+
+// DevicePath returns the path of the nbd device with the given index.
+func DevicePath(index int) string {
+	return fmt.Sprintf("/dev/nbd%d", index)
+}
+
+func newNetlinkServer(kc kernelControl, nl *NetlinkConn, index int, block BlockDevice, size int64, opts BlockDeviceOptions) *NbdServer {
+	s := newNbdServer(kc, block, size, opts)
+	s.nlConn = nl
+	s.index = index
+	s.name = DevicePath(index)
+	s.sysfs = fmt.Sprintf("/sys/block/nbd%d", index)
+	s.logger = s.logger.With("index", index)
+	if opts.BackendIdentifier != "" && !nl.SupportsBackendIdentifier() {
+		s.logger.Warn("nbd: kernel doesn't support BackendIdentifier, so will ignore it")
+	}
+	return s
+}
+
+// Transport returns the transport used to configure the kernel, and the
+// features of it in use.
+func (s *NbdServer) Transport() TransportInfo {
+	if s.nlConn == nil {
+		return TransportInfo{Transport: TransportIoctl}
+	}
+	return TransportInfo{
+		Transport:         TransportNetlink,
+		NetlinkVersion:    s.nlConn.Version(),
+		BackendIdentifier: s.nlConn.SupportsBackendIdentifier(),
+	}
+}
+
+func (s *NbdServer) characteristics() DeviceCharacteristics {
+	c := s.opts.DeviceCharacteristics
+	if bc, ok := s.block.(BlockDeviceCharacterizer); ok {
+		bcc := bc.Characteristics()
+		c.Rotational = c.Rotational || bcc.Rotational
+	}
+	return c
 }
 
 func (s *NbdServer) runNetlink(f *os.File, fd int) error {
@@ -147,9 +504,15 @@ func (s *NbdServer) runNetlink(f *os.File, fd int) error {
 	s.nlConn.SetSize(uint64(s.size))
 	s.nlConn.SetBlockSize(uint64(s.opts.BlockSize))
 
+	s.nlConn.SetDisconnectOnClose(s.opts.DisconnectOnClose)
+	s.nlConn.SetBackendIdentifier(s.opts.BackendIdentifier)
+
 	if s.opts.Readonly {
 		s.nlConn.SetReadonly(true)
 	}
+	if s.characteristics().Rotational {
+		s.nlConn.SetRotational(true)
+	}
 	if _, ok := s.block.(BlockDeviceFlusher); ok {
 		s.nlConn.SetSupportsFlush(true)
 	}
@@ -160,21 +523,30 @@ func (s *NbdServer) runNetlink(f *os.File, fd int) error {
 	err := s.nlConn.Connect()
 	if err != nil {
 		f.Close()
-		log.Println("Error connecting to NBD: ", err)
-		return err
+		s.logger.Error("nbd: error connecting to NBD", "error", err)
+		return s.startFailed(err)
 	}
+	s.connected()
 
 	go s.do(f)
+	err = s.dropPrivileges()
+	if err != nil {
+		s.Disconnect()
+	}
 	<-s.doneCh
 
-	return nil
+	return err
 }
 
 func (s *NbdServer) Run() error {
+	if s.opts.DropPrivileges != nil && s.nlConn == nil && s.sysfs == "" {
+		return s.startFailed(errors.New("nbd: DropPrivileges requires the sysfs directory of the device"))
+	}
+
 	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
 	if err != nil {
-		log.Println("Error creating socket pair: ", err)
-		return err
+		s.logger.Error("nbd: error creating socket pair", "error", err)
+		return s.startFailed(err)
 	}
 	f := os.NewFile(uintptr(fds[1]), "nbd-sock")
 
@@ -182,30 +554,33 @@ func (s *NbdServer) Run() error {
 		return s.runNetlink(f, fds[0])
 	}
 
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdSetSock, uintptr(fds[0]))
-	if errno != 0 {
-		log.Println("Error setting NBD socket:", errno)
-		return errno
+	err = s.kc.ioctl(s.devFd, nbdSetSock, uintptr(fds[0]))
+	if err != nil {
+		s.logger.Error("nbd: error setting NBD socket", "error", err)
+		return s.startFailed(err)
 	}
-	_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdSetBlkSize, uintptr(s.opts.BlockSize))
-	if errno != 0 {
-		log.Println("Error setting NBD block size:", errno)
-		return errno
+	err = s.kc.ioctl(s.devFd, nbdSetBlkSize, uintptr(s.opts.BlockSize))
+	if err != nil {
+		s.logger.Error("nbd: error setting NBD block size", "error", err)
+		return s.startFailed(err)
 	}
 	sizeBlocks := s.size / int64(s.opts.BlockSize)
 	if int64(uintptr(sizeBlocks)) != sizeBlocks {
-		return fmt.Errorf("File size %d too big for arch, bs=%d, blocks=%d", s.size, s.opts.BlockSize, sizeBlocks)
+		return s.startFailed(fmt.Errorf("File size %d too big for arch, bs=%d, blocks=%d", s.size, s.opts.BlockSize, sizeBlocks))
 	}
-	_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdSetSizeBlocks, uintptr(sizeBlocks))
-	if errno != 0 {
-		log.Println("Error setting NBD size blocks:", errno)
-		return errno
+	err = s.kc.ioctl(s.devFd, nbdSetSizeBlocks, uintptr(sizeBlocks))
+	if err != nil {
+		s.logger.Error("nbd: error setting NBD size blocks", "error", err)
+		return s.startFailed(err)
 	}
 
 	var flags uint16
 	if s.opts.Readonly {
 		flags |= nbdFlagHasFlags | nbdFlagReadOnly
 	}
+	if s.characteristics().Rotational {
+		flags |= nbdFlagHasFlags | nbdFlagRotational
+	}
 	if _, ok := s.block.(BlockDeviceFlusher); ok {
 		flags |= nbdFlagHasFlags | nbdFlagSendFlush
 	}
@@ -213,121 +588,431 @@ func (s *NbdServer) Run() error {
 		flags |= nbdFlagHasFlags | nbdFlagSendTrim
 	}
 	if flags != 0 {
-		_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdSetFlags, uintptr(flags))
-		if errno != 0 {
-			log.Println("Error setting NBD flags:", errno)
-			return errno
+		err = s.kc.ioctl(s.devFd, nbdSetFlags, uintptr(flags))
+		if err != nil {
+			s.logger.Error("nbd: error setting NBD flags", "error", err)
+			return s.startFailed(err)
 		}
 	}
 
+	// The device is connected once it has started, which it never does if
+	// NBD_DO_IT fails.
+	startCtx, cancelStart := context.WithCancel(context.Background())
+	startCh := make(chan error, 1)
+	go func() { startCh <- s.waitStarted(startCtx) }()
+
 	go s.do(f)
-	_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdDoIt, 0)
-	if errno != 0 {
-		return errno
+	err = s.kc.ioctl(s.devFd, nbdDoIt, 0)
+	cancelStart()
+	startErr := <-startCh
+	if err != nil {
+		s.logger.Error("nbd: error running NBD device", "error", err)
+		// The kernel won't use the socket, so end the connection to stop the
+		// server.
+		s.startErr.Store(&err)
+		unix.Shutdown(fds[0], unix.SHUT_RDWR)
+		<-s.doneCh
+		return err
 	}
-
-	return nil
+	return startErr
 }
 
 func (s *NbdServer) Disconnect() error {
+	// Requests, including the disconnect, aren't received while paused.
+	s.Resume()
+
+	if s.privDropped.Load() {
+		// The kernel would refuse to disconnect.
+		return s.shutdownSock()
+	}
 	if s.nlConn != nil {
 		return s.nlConn.Disconnect()
 	}
 
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdDisconnect, 0)
-	if errno != 0 {
-		return errno
+	return s.kc.ioctl(s.devFd, nbdDisconnect, 0)
+}
+
+// Workers returns the number of worker goroutines currently performing
+// requests.
+func (s *NbdServer) Workers() int {
+	return int(s.numWorkers.Load())
+}
+
+// BufferStats returns statistics about the server's data buffers.
+func (s *NbdServer) BufferStats() BufferStats {
+	st := BufferStats{
+		PoolHits:   s.reqPool.buffers().hits.Load() + s.replyPool.buffers().hits.Load(),
+		PoolAllocs: s.reqPool.buffers().allocs.Load() + s.replyPool.buffers().allocs.Load(),
 	}
-	return nil
+	s.bufLimit.stats(&st)
+	return st
 }
 
-var (
-	reqPool   RequestPool
-	replyPool ReplyPool
-)
+// newReply returns the reply for req, with a buffer for the data of reads.
+func (s *NbdServer) newReply(req *Request) *Reply {
+	size := 0
+	if req.cmd == nbdCmdRead {
+		size = int(req.length)
+	}
+	return s.newReplySize(req, size)
+}
+
+// newReplySize returns the reply for req, with a buffer of size bytes.
+func (s *NbdServer) newReplySize(req *Request, size int) *Reply {
+	reply := s.replyPool.Get(req.handle, size)
+	// The reservation for the request's data is released once the reply has
+	// been sent.
+	reply.reserved, req.reserved = req.reserved, 0
+	reply.info = req.info
+	return reply
+}
+
+// spliceRead reads the data of read request req into a pipe, and returns its
+// reply. Returns nil if the data is too large to be spliced, in which case it
+// must be read into a buffer instead.
+func (s *NbdServer) spliceRead(req *Request) *Reply {
+	p, err := s.sp.readAt(int64(req.offset), int(req.length))
+	if p == nil && err == nil {
+		return nil
+	}
+	reply := s.newReplySize(req, 0)
+	if p != nil {
+		reply.sp, reply.pipe, reply.pipeLen = s.sp, p, int(req.length)
+	}
+	s.finishRequest(req, reply, err)
+	return reply
+}
+
+// finishRequest sets the result of req on its reply.
+func (s *NbdServer) finishRequest(req *Request, reply *Reply, err error) {
+	if isFailure(err) {
+		s.recordFailure()
+	}
+	s.completeRequest(req, reply, err)
+}
+
+// completeRequest sets the result of req on its reply, without counting a
+// failure.
+func (s *NbdServer) completeRequest(req *Request, reply *Reply, err error) {
+	if err != nil {
+		s.logRequest(slog.LevelDebug, "nbd: request failed", req, err)
+		reply.SetError(nbdEio)
+	}
+	s.metrics.completed(req, reply.err, time.Since(req.received))
+	s.inFlight.remove(req)
+	s.observeCompleted(req, err)
+}
+
+func (s *NbdServer) logRequest(level slog.Level, msg string, req *Request, err error) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, level) {
+		return
+	}
+	s.logger.LogAttrs(ctx, level, msg,
+		slog.String("op", Command(req.cmd).String()),
+		slog.Uint64("offset", req.offset),
+		slog.Uint64("length", uint64(req.length)),
+		slog.Uint64("handle", req.handle),
+		slog.Any("error", err))
+}
 
 func (s *NbdServer) doRequest(req *Request) *Reply {
-	writeBufSize := 0
-	if req.cmd == nbdCmdRead {
-		writeBufSize = int(req.length)
+	err := s.refuse(req)
+	// Spliced reads can't be ordered against later writes, since the data
+	// shares the file's pages until the kernel has received it.
+	if err == nil && req.cmd == nbdCmdRead && s.sp != nil && !s.opts.OrderOverlapping {
+		if reply := s.spliceRead(req); reply != nil {
+			return reply
+		}
 	}
-	reply := replyPool.Get(req.handle, writeBufSize)
+	reply := s.newReply(req)
 
-	var err error
+	switch {
+	case err != nil:
+	case req.pipe != nil:
+		err = s.sp.writeAt(req)
+	default:
+		op := req.op()
+		switch req.cmd {
+		case nbdCmdRead:
+			op.Data = reply.Buffer()
+		case nbdCmdWrite:
+			op.Data = req.Buffer()
+		}
+		err = s.guard(func() error {
+			return s.handler.Handle(op)
+		})
+	}
+	s.finishRequest(req, reply, err)
+	return reply
+}
+
+// doWrites performs adjacent write requests with a single write, and
+// appends their replies to replies.
+func (s *NbdServer) doWrites(reqs []*Request, replies []*Reply) []*Reply {
+	first := reqs[0]
+	total := 0
+	for _, req := range reqs {
+		total += int(req.length)
+	}
+	buf := s.reqPool.buffers().get(total)
+	b := *buf
+	for _, req := range reqs {
+		n := copy(b, req.Buffer())
+		b = b[n:]
+	}
+	op := first.op()
+	op.Length = uint32(total)
+	op.Data = *buf
+	err := s.refuse(first)
+	if err == nil {
+		err = s.guard(func() error {
+			return s.handler.Handle(op)
+		})
+	}
+	s.reqPool.buffers().put(buf)
+
+	// The merged writes were a single call to the block device, so count one
+	// failure.
+	if isFailure(err) {
+		s.recordFailure()
+	}
+	for _, req := range reqs {
+		reply := s.newReply(req)
+		s.completeRequest(req, reply, err)
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// submitRequest submits req to an AsyncBlockDevice. The reply is sent to
+// replyCh on completion, after which done is called.
+func (s *NbdServer) submitRequest(ctx context.Context, dev AsyncBlockDevice, req *Request, replyCh chan<- *Reply, done func()) {
+	if time.Until(req.throttled) > 0 {
+		// Wait without blocking the receive loop.
+		go func() {
+			if waitThrottled(ctx, req) != nil {
+				s.reqPool.Put(req)
+				done()
+				return
+			}
+			s.submitRequest(ctx, dev, req, replyCh, done)
+		}()
+		return
+	}
+	if ch := req.waitChan(); ch != nil {
+		select {
+		case <-ch:
+		default:
+			// Wait for earlier overlapping requests without blocking the receive
+			// loop.
+			go func() {
+				select {
+				case <-ch:
+					s.submitRequest(ctx, dev, req, replyCh, done)
+				case <-ctx.Done():
+					s.reqPool.Put(req)
+					done()
+				}
+			}()
+			return
+		}
+	}
+
+	reply := s.newReply(req)
+	op := req.op()
+	supported := true
 	switch req.cmd {
 	case nbdCmdRead:
-		var n int
-		n, err = s.block.ReadAt(reply.Buffer(), int64(req.offset))
-		if err == io.EOF && n == int(req.length) {
-			// io.ReaderAt is allowed to return EOF on a complete read, which should
-			// not be treated an an error.
-			err = nil
-		}
+		op.Data = reply.Buffer()
 	case nbdCmdWrite:
-		_, err = s.block.WriteAt(req.Buffer(), int64(req.offset))
+		op.Data = req.Buffer()
 	case nbdCmdFlush:
-		err = s.block.(BlockDeviceFlusher).Flush()
+		_, supported = dev.(BlockDeviceFlusher)
 	case nbdCmdTrim:
-		err = s.block.(BlockDeviceTrimer).Trim(int64(req.offset), req.length)
-	case nbdCmdCache:
-		fallthrough
-	case nbdCmdWriteZeroes:
-		fallthrough
+		_, supported = dev.(BlockDeviceTrimer)
 	default:
-		log.Println("Unsupported operation", req.cmd)
+		supported = false
+	}
+
+	// Guards against completing twice if Submit panics after calling complete.
+	var completed atomic.Bool
+	complete := func(err error) {
+		if !completed.CompareAndSwap(false, true) {
+			return
+		}
+		s.ranges.release(req)
+		s.finishRequest(req, reply, err)
+		s.reqPool.Put(req)
+		select {
+		case replyCh <- reply:
+		case <-ctx.Done():
+			s.replyPool.Put(reply)
+		}
+		done()
+	}
+	s.observeDispatched(req)
+	s.inFlight.dispatched(req, -1)
+	err := s.refuse(req)
+	if err == nil && !supported {
 		err = ErrUnsupported
 	}
+	if err == nil {
+		err = s.guard(func() error {
+			dev.Submit(op, complete)
+			return nil
+		})
+	}
 	if err != nil {
-		log.Printf("NBD %v error: %v", req, err)
-		reply.SetError(nbdEio)
+		complete(err)
 	}
-	return reply
 }
 
-func (s *NbdServer) do(f *os.File) {
-	defer close(s.doneCh)
-	defer f.Close()
+func (s *NbdServer) recvWriteData(req *Request, b *bufio.Reader) error {
+	if s.sp != nil {
+		spliced, err := s.sp.recvData(req, b)
+		if err != nil {
+			s.reqPool.Put(req)
+			return err
+		}
+		if spliced {
+			return nil
+		}
+	}
+	return s.reqPool.recvData(req, b)
+}
 
-	g, ctx := errgroup.WithContext(context.Background())
+// useBackendLocked makes dev the block device requests are performed on, and
+// decides how requests are performed on it. Must be called with backendLock
+// held, while no requests are active.
+func (s *NbdServer) useBackendLocked(dev BlockDevice) {
+	s.block = dev
+	s.async = nil
+	if async, ok := dev.(AsyncBlockDevice); ok && len(s.opts.Middleware) == 0 {
+		s.async = async
+	}
+	if bfd, ok := dev.(BlockDeviceFd); ok && s.async == nil && len(s.opts.Middleware) == 0 && s.sock != nil {
+		s.sp = newSplicer(int(bfd.BackingFd()), s.sock, s.opts.ConcurrentOps)
+	}
+	if s.opts.ReadAheadBytes > 0 && s.async == nil && s.sp == nil {
+		s.ra = newReadAhead(s, dev, s.opts.ReadAheadBytes, s.opts.ReadAheadCacheBytes)
+	}
+}
 
-	var replyLock sync.Mutex
+// releaseBackendLocked stops using the current block device, and waits for
+// any prefetches from it. Must be called with backendLock held, while no
+// requests are active.
+func (s *NbdServer) releaseBackendLocked() {
+	if s.sp != nil {
+		s.sp.close()
+		s.sp = nil
+	}
+	s.ra.wait()
+	s.ra = nil
+	s.async = nil
+}
 
-	workers := s.opts.ConcurrentOps
-	if workers <= 0 {
-		workers = DefaultConcurrentOps
+// SwapBackend replaces the block device while the server is running, without
+// disconnecting the device. New requests are held until in-flight requests
+// have completed and the old block device has been flushed, then are
+// performed on dev. The old block device can be closed once SwapBackend
+// returns. If flushing the old block device fails, it continues to be used.
+//
+// dev must have the same size and contents as the old block device. Whether
+// flush and trim are supported is only sent to the kernel on connection, so
+// if dev doesn't support them, those requests fail.
+func (s *NbdServer) SwapBackend(dev BlockDevice) error {
+	err := s.quiesce.pause(context.Background())
+	if err != nil {
+		return err
 	}
+	defer s.quiesce.resume()
 
-	reqCh := make(chan *Request, workers)
+	s.backendLock.Lock()
+	if f, ok := s.block.(BlockDeviceFlusher); ok {
+		err = s.guard(f.Flush)
+		if err != nil {
+			s.backendLock.Unlock()
+			s.logger.Error("nbd: error flushing block device before swap", "error", err)
+			return err
+		}
+	}
+	s.releaseBackendLocked()
+	s.useBackendLocked(dev)
+	s.backendLock.Unlock()
 
-	for i := 0; i < workers; i++ {
-		g.Go(func() error {
-			var req *Request
-			for {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case req = <-reqCh:
-					if req == nil {
-						return nil
-					}
-				}
+	s.logger.Info("nbd: swapped block device")
+	s.sendEvent(Event{Type: EventBackendSwapped})
+	return nil
+}
 
-				reply := s.doRequest(req)
-				reqPool.Put(req)
+// replySent is called once reply has been sent to the kernel.
+func (s *NbdServer) replySent(reply *Reply) {
+	s.observeSent(reply)
+	s.quiesce.exit()
+}
 
-				replyLock.Lock()
-				err := reply.Send(f)
-				replyLock.Unlock()
+func (s *NbdServer) do(f *os.File) {
+	defer close(s.doneCh)
 
-				replyPool.Put(reply)
-				if err != nil {
-					log.Printf("Error writing NBD reply: %v", err)
-					return err
-				}
-			}
-		})
+	// Using a net.Conn allows replies to be sent with writev.
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		s.logger.Error("nbd: error creating NBD connection", "error", err)
+		s.Disconnect()
+		s.sendEvent(Event{Type: EventDisconnected, Reason: DisconnectFailed, Err: err})
+		return
+	}
+	defer conn.Close()
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	s.backendLock.Lock()
+	if rc, err := conn.(syscall.Conn).SyscallConn(); err == nil {
+		s.sock = rc
+	}
+	s.useBackendLocked(s.block)
+	bufSize := readBufferSize
+	if s.sp != nil {
+		bufSize = spliceReadBufferSize
+	}
+	s.backendLock.Unlock()
+	defer func() {
+		s.backendLock.Lock()
+		s.releaseBackendLocked()
+		s.sock = nil
+		s.backendLock.Unlock()
+	}()
+
+	rw := newReplyWriter(conn, s.replySent, &s.replyPool)
+
+	// Tracks everything which might send a reply: the workers, outstanding
+	// asynchronous requests, and the receive loop which creates them.
+	var senders sync.WaitGroup
+	senders.Add(1)
+
+	if s.opts.OrderOverlapping || s.opts.FlushBarrier {
+		s.ranges = newRangeLocker(s.opts.OrderOverlapping, s.opts.FlushBarrier)
 	}
 
+	// Workers are started when the first request is received which isn't
+	// submitted to an AsyncBlockDevice.
+	var workers *workerPool
+	// Requests waiting to be dispatched to the workers due to rate limits.
+	var throttled sync.WaitGroup
+	g.Go(func() error {
+		err := rw.run()
+		if err != nil {
+			s.logger.Error("nbd: error writing NBD reply", "error", err)
+		}
+		return err
+	})
+	go func() {
+		senders.Wait()
+		close(rw.ch)
+	}()
+
 	go func() {
 		err := g.Wait()
 		if err != nil {
@@ -335,29 +1020,137 @@ func (s *NbdServer) do(f *os.File) {
 		}
 	}()
 
-	var err error
-	bufr := bufio.NewReaderSize(f, readBufferSize)
+	bufr := bufio.NewReaderSize(conn, bufSize)
+	first := true
 	for {
-		req, err := reqPool.Recv(bufr)
+		var req *Request
+		req, err = s.reqPool.recvHeader(ctx, bufr)
 		if err != nil {
 			break
 		}
-
+		req.received = time.Now()
 		if req.cmd == nbdCmdDisc {
+			s.reqPool.Put(req)
+			err = nil
 			break
 		}
 
-		reqCh <- req
+		// Wait while requests are quiesced, leaving later requests in the
+		// socket.
+		err = s.quiesce.enter(ctx)
+		if err != nil {
+			s.reqPool.Put(req)
+			break
+		}
+		if req.cmd == nbdCmdWrite {
+			err = s.recvWriteData(req, bufr)
+			if err != nil {
+				break
+			}
+		}
+
+		if first {
+			first = false
+			// Requests are only sent once the device has started.
+			s.connected()
+			s.sendEvent(Event{Type: EventFirstRequest})
+		}
+		s.metrics.received()
+		s.observeReceived(req)
+		if !s.inFlight.add(req) {
+			s.logger.Warn("nbd: duplicate request handle",
+				"op", Command(req.cmd).String(), "handle", req.handle)
+		}
+		req.throttled = s.limiter.schedule(req)
+		if s.ranges != nil && s.async == nil {
+			// Workers wait for earlier conflicting requests, so requests must be
+			// dispatched in order. Otherwise a later request could occupy every
+			// worker while waiting for a throttled one.
+			err = waitThrottled(ctx, req)
+			if err != nil {
+				s.reqPool.Put(req)
+				break
+			}
+		}
+		s.ranges.add(req)
+		s.ra.observe(req)
+
+		if s.async != nil {
+			if err = ctx.Err(); err != nil {
+				s.reqPool.Put(req)
+				break
+			}
+			senders.Add(1)
+			s.submitRequest(ctx, s.async, req, rw.ch, senders.Done)
+			continue
+		}
+
+		if workers == nil {
+			workers = newWorkerPool(s, ctx, g, rw.ch, &senders)
+			workers.start()
+			s.workers.Store(workers)
+		}
+		if time.Until(req.throttled) > 0 {
+			// Wait without holding up other requests, or occupying a worker.
+			throttled.Add(1)
+			go func(req *Request) {
+				defer throttled.Done()
+				if waitThrottled(ctx, req) != nil || workers.dispatch(req) != nil {
+					s.reqPool.Put(req)
+				}
+			}(req)
+			continue
+		}
+		err = workers.dispatch(req)
+		if err != nil {
+			s.reqPool.Put(req)
+			break
+		}
 	}
-	close(reqCh)
+	throttled.Wait()
+	if workers != nil {
+		workers.stop()
+	}
+	senders.Done()
 
-	if err != nil {
-		log.Println("Error in main server loop", err)
+	if err != nil && err != io.EOF {
+		s.logger.Error("nbd: error receiving NBD request", "error", err)
 	}
 
-	g.Wait()
+	ev := Event{Type: EventDisconnected}
+	if gErr := g.Wait(); gErr != nil {
+		// Replies couldn't be sent, which also stops the receive loop.
+		err = gErr
+	}
+	// Release requests and replies left behind if the workers or reply writer
+	// stopped early.
+	if workers != nil {
+		workers.discard()
+	}
+	rw.discard()
+	// The device can't be seen to start after it has been disconnected.
+	s.connectOnce.Do(func() {})
+	switch {
+	case s.startErr.Load() != nil:
+		ev.Reason = DisconnectFailed
+		ev.Err = *s.startErr.Load()
+	case s.errorDisconnect.Load():
+		ev.Reason = DisconnectErrorThreshold
+	case s.shutdown.Load():
+		ev.Reason = DisconnectRequested
+	case err == nil:
+		ev.Reason = DisconnectRequested
+	case err == io.EOF:
+		ev.Reason = DisconnectClosed
+	default:
+		ev.Reason = DisconnectFailed
+		ev.Err = err
+	}
+	s.quiesce.close()
+	s.inFlight.reset()
 	if s.nlConn == nil {
-		unix.Syscall(unix.SYS_IOCTL, uintptr(s.devFd), nbdClearSock, 0)
+		s.kc.ioctl(s.devFd, nbdClearSock, 0)
 		unix.Close(s.devFd)
 	}
+	s.sendEvent(ev)
 }
@@ -0,0 +1,503 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in the tests, so that a deadlock fails the
+// test instead of hanging it.
+const testTimeout = 5 * time.Second
+
+// memDevice is an in-memory BlockDevice which supports trim and flush.
+type memDevice struct {
+	lock    sync.Mutex
+	data    []byte
+	trims   int
+	flushes int
+}
+
+func newMemDevice(size int) *memDevice {
+	return &memDevice{data: make([]byte, size)}
+}
+
+func (d *memDevice) ReadAt(b []byte, off int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return copy(b, d.data[off:]), nil
+}
+
+func (d *memDevice) WriteAt(b []byte, off int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return copy(d.data[off:], b), nil
+}
+
+func (d *memDevice) Trim(off int64, length uint32) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	clear(d.data[off : off+int64(length)])
+	d.trims++
+	return nil
+}
+
+func (d *memDevice) Flush() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.flushes++
+	return nil
+}
+
+// gatedDevice is a memDevice whose reads, writes and flushes each report
+// their offset on started, and then wait to be released. Flushes report an
+// offset of -1.
+type gatedDevice struct {
+	*memDevice
+	started chan int64
+
+	gateLock sync.Mutex
+	gates    map[int64]chan struct{}
+}
+
+func newGatedDevice(size int) *gatedDevice {
+	return &gatedDevice{
+		memDevice: newMemDevice(size),
+		started:   make(chan int64, 16),
+		gates:     make(map[int64]chan struct{}),
+	}
+}
+
+// gate returns the channel which operations at off wait on.
+func (d *gatedDevice) gate(off int64) chan struct{} {
+	d.gateLock.Lock()
+	defer d.gateLock.Unlock()
+	g, ok := d.gates[off]
+	if !ok {
+		g = make(chan struct{})
+		d.gates[off] = g
+	}
+	return g
+}
+
+func (d *gatedDevice) wait(off int64) {
+	d.started <- off
+	<-d.gate(off)
+}
+
+func (d *gatedDevice) ReadAt(b []byte, off int64) (int, error) {
+	d.wait(off)
+	return d.memDevice.ReadAt(b, off)
+}
+
+func (d *gatedDevice) WriteAt(b []byte, off int64) (int, error) {
+	d.wait(off)
+	return d.memDevice.WriteAt(b, off)
+}
+
+func (d *gatedDevice) Flush() error {
+	d.wait(-1)
+	return d.memDevice.Flush()
+}
+
+// expectStart checks that the next operation to start is at off.
+func (d *gatedDevice) expectStart(t *testing.T, off int64) {
+	t.Helper()
+	select {
+	case got := <-d.started:
+		if got != off {
+			t.Fatalf("operation at %d started, want %d", got, off)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("operation at %d didn't start", off)
+	}
+}
+
+// expectNoStart checks that no operation starts for a while.
+func (d *gatedDevice) expectNoStart(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-d.started:
+		t.Fatalf("operation at %d started early", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// release lets one started operation at off complete.
+func (d *gatedDevice) release(t *testing.T, off int64) {
+	t.Helper()
+	select {
+	case d.gate(off) <- struct{}{}:
+	case <-time.After(testTimeout):
+		t.Fatalf("no operation at %d to release", off)
+	}
+}
+
+// testLogger discards log output, so that expected errors don't clutter test
+// output.
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestServer creates a server using netlink on a fake kernel.
+func newTestServer(t *testing.T, block BlockDevice, size int64, opts BlockDeviceOptions) (*NbdServer, *fakeKernel) {
+	t.Helper()
+	if opts.Logger == nil {
+		opts.Logger = testLogger()
+	}
+	k := newFakeKernel(nbdNlVersion)
+	s, err := newServerWithNetlink(k, 0, block, size, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, k
+}
+
+// testConn is the kernel's end of the connection to a running server.
+type testConn struct {
+	t      *testing.T
+	s      *NbdServer
+	conn   net.Conn
+	runErr chan error
+}
+
+// startServer runs s, and waits for it to hand its socket to k and start the
+// device, so that the device's setup is complete.
+func startServer(t *testing.T, s *NbdServer, k *fakeKernel) *testConn {
+	t.Helper()
+	c := &testConn{t: t, s: s, runErr: make(chan error, 1)}
+	go func() { c.runErr <- s.Run() }()
+
+	f, err := k.kernelSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c.conn, err = net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+
+	started := make(chan struct{})
+	go func() {
+		k.started()
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(testTimeout):
+		t.Fatal("device wasn't started")
+	}
+	return c
+}
+
+// send sends a request, followed by data.
+func (c *testConn) send(cmd uint16, handle, off uint64, length uint32, data []byte) {
+	c.t.Helper()
+	b := make([]byte, requestHeaderSize, requestHeaderSize+len(data))
+	binary.BigEndian.PutUint32(b[0:], nbdRequestMagic)
+	binary.BigEndian.PutUint16(b[6:], cmd)
+	binary.BigEndian.PutUint64(b[8:], handle)
+	binary.BigEndian.PutUint64(b[16:], off)
+	binary.BigEndian.PutUint32(b[24:], length)
+	b = append(b, data...)
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply receives a reply with dataLen bytes of data, if it succeeded.
+func (c *testConn) reply(dataLen int) (code uint32, handle uint64, data []byte) {
+	c.t.Helper()
+	code, handle, data, err := c.replyWithin(dataLen, testTimeout)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return code, handle, data
+}
+
+// replyWithin receives a reply like reply, waiting for up to d.
+func (c *testConn) replyWithin(dataLen int, d time.Duration) (code uint32, handle uint64, data []byte, err error) {
+	c.conn.SetReadDeadline(time.Now().Add(d))
+	var hdr [replyHeaderSize]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	if magic := binary.BigEndian.Uint32(hdr[0:]); magic != nbdReplyMagic {
+		return 0, 0, nil, errors.New("bad reply magic")
+	}
+	code = binary.BigEndian.Uint32(hdr[4:])
+	handle = binary.BigEndian.Uint64(hdr[8:])
+	if code == 0 && dataLen > 0 {
+		data = make([]byte, dataLen)
+		if _, err := io.ReadFull(c.conn, data); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return code, handle, data, nil
+}
+
+// write writes data at off, and checks the reply.
+func (c *testConn) write(handle, off uint64, data []byte) {
+	c.t.Helper()
+	c.send(nbdCmdWrite, handle, off, uint32(len(data)), data)
+	code, h, _ := c.reply(0)
+	if code != 0 || h != handle {
+		c.t.Fatalf("write reply: code %d, handle %d, want 0, %d", code, h, handle)
+	}
+}
+
+// read reads length bytes at off, and checks the reply.
+func (c *testConn) read(handle, off uint64, length uint32) []byte {
+	c.t.Helper()
+	c.send(nbdCmdRead, handle, off, length, nil)
+	code, h, data := c.reply(int(length))
+	if code != 0 || h != handle {
+		c.t.Fatalf("read reply: code %d, handle %d, want 0, %d", code, h, handle)
+	}
+	return data
+}
+
+// wait waits for Run to return.
+func (c *testConn) wait() error {
+	c.t.Helper()
+	select {
+	case err := <-c.runErr:
+		return err
+	case <-time.After(testTimeout):
+		c.t.Fatal("Run didn't return")
+		return nil
+	}
+}
+
+// stop disconnects the server, and waits for it to stop.
+func (c *testConn) stop() error {
+	c.t.Helper()
+	c.s.Disconnect()
+	err := c.wait()
+	select {
+	case <-c.s.doneCh:
+	case <-time.After(testTimeout):
+		c.t.Fatal("server didn't stop")
+	}
+	return err
+}
+
+// pattern returns n bytes of data which depend on seed.
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i) ^ seed
+	}
+	return b
+}
+
+func TestReadWriteTrimFlush(t *testing.T) {
+	dev := newMemDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 4})
+	c := startServer(t, s, k)
+
+	data := pattern(8192, 1)
+	c.write(1, 4096, data)
+	if got := c.read(2, 4096, 8192); string(got) != string(data) {
+		t.Error("read didn't return written data")
+	}
+
+	c.send(nbdCmdTrim, 3, 4096, 4096, nil)
+	if code, _, _ := c.reply(0); code != 0 {
+		t.Errorf("trim failed with %d", code)
+	}
+	c.send(nbdCmdFlush, 4, 0, 0, nil)
+	if code, _, _ := c.reply(0); code != 0 {
+		t.Errorf("flush failed with %d", code)
+	}
+	if got := c.read(5, 4096, 8192); string(got[:4096]) != string(make([]byte, 4096)) || string(got[4096:]) != string(data[4096:]) {
+		t.Error("trimmed range wasn't zeroed")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if dev.trims != 1 || dev.flushes != 1 {
+		t.Errorf("got %d trims and %d flushes, want 1 of each", dev.trims, dev.flushes)
+	}
+}
+
+func TestRequestFailureLogging(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+		t.Run(level.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+			dev := &failingDevice{memDevice: newMemDevice(1 << 20), err: errors.New("broken")}
+			s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{Logger: logger})
+			c := startServer(t, s, k)
+
+			c.send(nbdCmdWrite, 7, 0, 4096, pattern(4096, 1))
+			if code, _, _ := c.reply(0); code != nbdEio {
+				t.Errorf("write got error %d, want %d", code, nbdEio)
+			}
+			if err := c.stop(); err != nil {
+				t.Errorf("Run: %v", err)
+			}
+
+			var failures []map[string]any
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var rec map[string]any
+				if err := dec.Decode(&rec); err != nil {
+					t.Fatal(err)
+				}
+				if rec["msg"] == "nbd: request failed" {
+					failures = append(failures, rec)
+				}
+			}
+			// Failures are only logged at the debug level, since they are
+			// reported to the kernel, and could flood the log.
+			if level > slog.LevelDebug {
+				if len(failures) != 0 {
+					t.Errorf("logged failures %v at level %v", failures, level)
+				}
+				return
+			}
+			if len(failures) != 1 {
+				t.Fatalf("logged failures %v, want 1", failures)
+			}
+			want := map[string]any{"op": "Write", "offset": 0.0, "length": 4096.0, "handle": 7.0, "error": "broken"}
+			for key, v := range want {
+				if failures[0][key] != v {
+					t.Errorf("logged %s %v, want %v", key, failures[0][key], v)
+				}
+			}
+		})
+	}
+}
+
+func TestIoctlSequence(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		name  string
+		block BlockDevice
+		opts  BlockDeviceOptions
+		flags uintptr
+	}{
+		{"plain", struct{ BlockDevice }{newMemDevice(size)}, BlockDeviceOptions{}, 0},
+		{"trim and flush", newMemDevice(size), BlockDeviceOptions{},
+			nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendTrim},
+		{"read-only rotational", struct{ BlockDevice }{newMemDevice(size)},
+			BlockDeviceOptions{BlockSize: 4096, Readonly: true, DeviceCharacteristics: DeviceCharacteristics{Rotational: true}},
+			nbdFlagHasFlags | nbdFlagReadOnly | nbdFlagRotational},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Logger = testLogger()
+			k := newFakeKernel(0)
+			s, err := newServerFromFd(k, -1, tc.block, size, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := startServer(t, s, k)
+			if err := c.stop(); err != nil {
+				t.Errorf("Run: %v", err)
+			}
+
+			blockSize := uintptr(s.opts.BlockSize)
+			want := []ioctlCall{
+				{nbdSetSock, uintptr(k.sockFd)},
+				{nbdSetBlkSize, blockSize},
+				{nbdSetSizeBlocks, size / blockSize},
+			}
+			if tc.flags != 0 {
+				want = append(want, ioctlCall{nbdSetFlags, tc.flags})
+			}
+			want = append(want, ioctlCall{nbdDoIt, 0}, ioctlCall{nbdDisconnect, 0}, ioctlCall{nbdClearSock, 0})
+			got := k.ioctlCalls()
+			if len(got) != len(want) {
+				t.Fatalf("got ioctls %x, want %x", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("ioctl %d is %x, want %x", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIoctlRejectsNetlinkOptions(t *testing.T) {
+	for _, opts := range []BlockDeviceOptions{
+		{DisconnectOnClose: true},
+		{BackendIdentifier: "vol-1234"},
+	} {
+		opts.Logger = testLogger()
+		_, err := newServerFromFd(newFakeKernel(0), -1, newMemDevice(4096), 4096, opts)
+		if err == nil {
+			t.Errorf("created ioctl server with %+v", opts)
+		}
+	}
+}
+
+// volatileDevice is a memDevice whose writes are only durable once flushed.
+type volatileDevice struct {
+	*memDevice
+	durable []byte
+}
+
+func (d *volatileDevice) Flush() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	copy(d.durable, d.data)
+	d.flushes++
+	return nil
+}
+
+func TestFlushCoversCompletedWrites(t *testing.T) {
+	const n = 32
+	dev := &volatileDevice{memDevice: newMemDevice(1 << 20), durable: make([]byte, 1<<20)}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 8})
+	c := startServer(t, s, k)
+
+	// Flush once half the writes have completed, while others are in flight.
+	data := pattern(n*4096, 5)
+	for i := 0; i < n; i++ {
+		off := i * 4096
+		c.send(nbdCmdWrite, uint64(i), uint64(off), 4096, data[off:off+4096])
+	}
+	var acked []uint64
+	for len(acked) < n/2 {
+		code, h, _ := c.reply(0)
+		if code != 0 {
+			t.Fatalf("write %d failed with %d", h, code)
+		}
+		acked = append(acked, h)
+	}
+	c.send(nbdCmdFlush, n, 0, 0, nil)
+	for {
+		code, h, _ := c.reply(0)
+		if code != 0 {
+			t.Fatalf("request %d failed with %d", h, code)
+		}
+		if h == n {
+			break
+		}
+	}
+
+	dev.lock.Lock()
+	for _, h := range acked {
+		off := h * 4096
+		if string(dev.durable[off:off+4096]) != string(data[off:off+4096]) {
+			t.Errorf("write %d completed before the flush isn't durable", h)
+		}
+	}
+	dev.lock.Unlock()
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
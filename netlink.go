@@ -3,10 +3,11 @@ package nbd
 import (
 	"github.com/mdlayher/genetlink"
 	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 )
 
 type NetlinkConn struct {
-	conn   *genetlink.Conn
+	conn   genetlinkConn
 	family genetlink.Family
 	index  int
 
@@ -14,12 +15,23 @@ type NetlinkConn struct {
 	sizeBytes      uint64
 	blockSizeBytes uint64
 	readOnly       bool
+	rotational     bool
 	supportsTrim   bool
 	supportsFlush  bool
+
+	disconnectOnClose bool
+	backendId         string
+
+	// Whether the kernel accepts NBD_ATTR_BACKEND_IDENTIFIER.
+	hasBackendId bool
 }
 
 func NewNetlinkConn(index int) (*NetlinkConn, error) {
-	conn, err := genetlink.Dial(&netlink.Config{Strict: true})
+	return newNetlinkConn(sysKernel{}, index)
+}
+
+func newNetlinkConn(kc kernelControl, index int) (*NetlinkConn, error) {
+	conn, err := kc.dialNetlink()
 	if err != nil {
 		return nil, err
 	}
@@ -30,7 +42,84 @@ func NewNetlinkConn(index int) (*NetlinkConn, error) {
 		return nil, err
 	}
 
-	return &NetlinkConn{conn: conn, family: family, index: index}, nil
+	c := &NetlinkConn{conn: conn, family: family, index: index}
+	c.hasBackendId = c.policyHasAttr(nbdNlAttrBackendIdentifier)
+	return c, nil
+}
+
+// policyHasAttr reports whether the attribute policy of the family includes
+// attr. The kernel parses requests leniently, silently ignoring attributes it
+// doesn't know, and the family's version doesn't change when attributes are
+// added, so the policy is the only way to find out. Kernels which can't dump
+// policies (before 5.8) are assumed not to have attr.
+func (c *NetlinkConn) policyHasAttr(attr uint16) bool {
+	enc := netlink.NewAttributeEncoder()
+	enc.Uint16(unix.CTRL_ATTR_FAMILY_ID, c.family.ID)
+	buf, err := enc.Encode()
+	if err != nil {
+		return false
+	}
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: unix.CTRL_CMD_GETPOLICY,
+			Version: 1,
+		},
+		Data: buf,
+	}
+	msgs, err := c.conn.Execute(req, unix.GENL_ID_CTRL, netlink.Request|netlink.Dump)
+	if err != nil {
+		return false
+	}
+
+	found := false
+	for _, m := range msgs {
+		ad, err := netlink.NewAttributeDecoder(m.Data)
+		if err != nil {
+			return false
+		}
+		for ad.Next() {
+			if ad.Type() != unix.CTRL_ATTR_POLICY {
+				continue
+			}
+			ad.Nested(func(pad *netlink.AttributeDecoder) error {
+				for pad.Next() {
+					// The family's own policy is dumped first. Later policies
+					// are of nested attributes.
+					if pad.Type() != 0 {
+						continue
+					}
+					pad.Nested(func(aad *netlink.AttributeDecoder) error {
+						for aad.Next() {
+							if aad.Type() == attr {
+								found = true
+							}
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+		if ad.Err() != nil {
+			return false
+		}
+	}
+	return found
+}
+
+// Version returns the version of the kernel's "nbd" generic netlink family.
+func (c *NetlinkConn) Version() uint8 {
+	return c.family.Version
+}
+
+// SupportsBackendIdentifier returns true if the kernel accepts a backend
+// identifier (since Linux 5.19). Older kernels ignore it.
+func (c *NetlinkConn) SupportsBackendIdentifier() bool {
+	return c.hasBackendId
+}
+
+func (c *NetlinkConn) Close() error {
+	return c.conn.Close()
 }
 
 func (c *NetlinkConn) SetFd(fd int) {
@@ -49,6 +138,10 @@ func (c *NetlinkConn) SetReadonly(ro bool) {
 	c.readOnly = ro
 }
 
+func (c *NetlinkConn) SetRotational(rot bool) {
+	c.rotational = rot
+}
+
 func (c *NetlinkConn) SetSupportsTrim(trim bool) {
 	c.supportsTrim = trim
 }
@@ -57,16 +150,34 @@ func (c *NetlinkConn) SetSupportsFlush(flush bool) {
 	c.supportsFlush = flush
 }
 
+func (c *NetlinkConn) SetDisconnectOnClose(disc bool) {
+	c.disconnectOnClose = disc
+}
+
+func (c *NetlinkConn) SetBackendIdentifier(id string) {
+	c.backendId = id
+}
+
 func (c *NetlinkConn) Connect() error {
 	enc := netlink.NewAttributeEncoder()
 	enc.Uint32(nbdNlAttrIndex, uint32(c.index))
 	enc.Uint64(nbdNlAttrSizeBytes, c.sizeBytes)
 	enc.Uint64(nbdNlAttrBlockSizeBytes, c.blockSizeBytes)
-	enc.Uint64(nbdNlAttrClientFlags, nbdClientFlagDestroyOnDisconnect)
+	clientFlags := uint64(nbdClientFlagDestroyOnDisconnect)
+	if c.disconnectOnClose {
+		clientFlags |= nbdClientFlagDisconnectOnClose
+	}
+	enc.Uint64(nbdNlAttrClientFlags, clientFlags)
+	if c.backendId != "" {
+		enc.String(nbdNlAttrBackendIdentifier, c.backendId)
+	}
 	var flags uint64
 	if c.readOnly {
 		flags |= nbdFlagReadOnly
 	}
+	if c.rotational {
+		flags |= nbdFlagRotational
+	}
 	if c.supportsTrim {
 		flags |= nbdFlagSendTrim
 	}
@@ -0,0 +1,86 @@
+package nbd
+
+import (
+	"testing"
+)
+
+func TestNetlinkConnectAttributes(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		name        string
+		block       BlockDevice
+		opts        BlockDeviceOptions
+		serverFlags uint64
+		clientFlags uint64
+	}{
+		{"plain", struct{ BlockDevice }{newMemDevice(size)}, BlockDeviceOptions{},
+			0, nbdClientFlagDestroyOnDisconnect},
+		{"trim and flush", newMemDevice(size), BlockDeviceOptions{},
+			nbdFlagSendFlush | nbdFlagSendTrim, nbdClientFlagDestroyOnDisconnect},
+		{"all options", newMemDevice(size),
+			BlockDeviceOptions{
+				BlockSize:             4096,
+				Readonly:              true,
+				DeviceCharacteristics: DeviceCharacteristics{Rotational: true},
+				DisconnectOnClose:     true,
+				BackendIdentifier:     "vol-1234",
+			},
+			nbdFlagReadOnly | nbdFlagRotational | nbdFlagSendFlush | nbdFlagSendTrim,
+			nbdClientFlagDestroyOnDisconnect | nbdClientFlagDisconnectOnClose},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Logger = testLogger()
+			k := newFakeKernel(nbdNlVersion)
+			s, err := newServerWithNetlink(k, 3, tc.block, size, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := startServer(t, s, k)
+			if err := c.stop(); err != nil {
+				t.Errorf("Run: %v", err)
+			}
+			if calls := k.ioctlCalls(); len(calls) != 0 {
+				t.Errorf("got ioctls %x with netlink", calls)
+			}
+
+			reqs := k.netlinkRequests()
+			if len(reqs) != 2 || reqs[0].cmd != nbdNlCmdConnect || reqs[1].cmd != nbdNlCmdDisconnect {
+				t.Fatalf("got netlink requests %+v, want connect and disconnect", reqs)
+			}
+			conn := reqs[0]
+			if conn.index != 3 {
+				t.Errorf("connect index is %d, want 3", conn.index)
+			}
+			if conn.sizeBytes != size {
+				t.Errorf("connect size is %d, want %d", conn.sizeBytes, size)
+			}
+			if conn.blockSizeBytes != uint64(s.opts.BlockSize) {
+				t.Errorf("connect block size is %d, want %d", conn.blockSizeBytes, s.opts.BlockSize)
+			}
+			if conn.serverFlags != tc.serverFlags {
+				t.Errorf("connect server flags are %#x, want %#x", conn.serverFlags, tc.serverFlags)
+			}
+			if conn.clientFlags != tc.clientFlags {
+				t.Errorf("connect client flags are %#x, want %#x", conn.clientFlags, tc.clientFlags)
+			}
+			if conn.backendId != tc.opts.BackendIdentifier {
+				t.Errorf("connect backend identifier is %q, want %q", conn.backendId, tc.opts.BackendIdentifier)
+			}
+			if len(conn.sockets) != 1 || conn.sockets[0] != k.sockFd {
+				t.Errorf("connect sockets are %v, want [%d]", conn.sockets, k.sockFd)
+			}
+			if reqs[1].index != 3 {
+				t.Errorf("disconnect index is %d, want 3", reqs[1].index)
+			}
+		})
+	}
+}
+
+func TestNetlinkUnavailable(t *testing.T) {
+	k := newFakeKernel(0)
+	_, err := newServerWithNetlink(k, 0, newMemDevice(4096), 4096, BlockDeviceOptions{Logger: testLogger()})
+	if err == nil {
+		t.Error("created netlink server without the nbd family")
+	}
+}
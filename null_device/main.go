@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/akmistry/go-nbd"
 )
@@ -20,9 +22,10 @@ const (
 )
 
 var (
-	dev        = flag.String("device", "/dev/nbd0", "Path to /dev/nbdX device")
-	size       = flag.Int64("size", 64*1024*1024*1024, "Size of device, in bytes")
-	useNetlink = flag.Bool("use-netlink", true, "Use netlink to initiate nbd")
+	dev  = flag.String("device", "/dev/nbd0", "Path to /dev/nbdX device")
+	size = flag.Int64("size", 64*1024*1024*1024, "Size of device, in bytes")
+	uid  = flag.Int("uid", -1, "User to switch to once the device is set up")
+	gid  = flag.Int("gid", -1, "Group to switch to once the device is set up")
 )
 
 type nullDevice struct {
@@ -50,21 +53,40 @@ func main() {
 		BlockSize:     blockSize,
 		ConcurrentOps: 4,
 	}
-
-	var err error
-	var nbdDevice *nbd.NbdServer
-	if *useNetlink {
-		index, err := strconv.ParseUint(strings.TrimPrefix(*dev, nbdPrefix), 10, 32)
-		if err != nil {
-			log.Panicln(err)
+	if *uid >= 0 || *gid >= 0 {
+		priv := nbd.Privileges{Uid: *uid, Gid: *gid}
+		// Check before the device is set up, since Drop failing would tear it
+		// down again.
+		if err := priv.Validate(); err != nil {
+			log.Println("invalid -uid or -gid: ", err)
+			return
 		}
-		nbdDevice, err = nbd.NewServerWithNetlink(int(index), nullDevice{}, *size, opts)
-	} else {
-		nbdDevice, err = nbd.NewServer(*dev, nullDevice{}, *size, opts)
+		opts.DropPrivileges = priv.Drop
+	}
+
+	index, err := strconv.ParseUint(strings.TrimPrefix(*dev, nbdPrefix), 10, 32)
+	if err != nil {
+		log.Panicln(err)
 	}
+	nbdDevice, err := nbd.NewServerAuto(int(index), nullDevice{}, *size, opts)
 	if err != nil {
 		log.Panicln(err)
 	}
+	log.Printf("nbd: using transport %+v", nbdDevice.Transport())
+
+	http.Handle("/metrics", nbdDevice.MetricsHandler())
+	http.Handle("/debug/nbd", nbdDevice.DebugHandler())
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := nbdDevice.WaitReady(ctx)
+		if err != nil {
+			log.Println("nbd: device not ready: ", err)
+			return
+		}
+		log.Println("nbd: device ready")
+	}()
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
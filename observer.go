@@ -0,0 +1,81 @@
+package nbd
+
+import (
+	"time"
+)
+
+// RequestInfo describes a request, and when it passed through each stage of
+// the server.
+type RequestInfo struct {
+	Command Command
+	Flags   uint16
+	Handle  uint64
+	Offset  uint64
+	Length  uint32
+
+	// Received is when the request was read from the kernel.
+	Received time.Time
+	// Dispatched is when the request was passed to the block device.
+	Dispatched time.Time
+	// Completed is when the block device finished the request.
+	Completed time.Time
+	// Sent is when the reply was written to the kernel.
+	Sent time.Time
+
+	// Err is the error returned by the block device, if any.
+	Err error
+}
+
+// Observer is notified as each request passes through the server. Calls for
+// a single request are made in order, but calls for different requests may
+// be concurrent. Methods should return quickly, since they are called inline.
+//
+// The same RequestInfo is passed to each method, and is updated by the server
+// between calls, so it must not be modified. It may be retained after
+// ReplySent.
+type Observer interface {
+	RequestReceived(info *RequestInfo)
+	RequestDispatched(info *RequestInfo)
+	RequestCompleted(info *RequestInfo)
+	ReplySent(info *RequestInfo)
+}
+
+func (s *NbdServer) observeReceived(req *Request) {
+	if s.opts.Observer == nil {
+		return
+	}
+	req.info = &RequestInfo{
+		Command:  Command(req.cmd),
+		Flags:    req.flags,
+		Handle:   req.handle,
+		Offset:   req.offset,
+		Length:   req.length,
+		Received: req.received,
+	}
+	s.opts.Observer.RequestReceived(req.info)
+}
+
+func (s *NbdServer) observeDispatched(req *Request) {
+	if req.info == nil {
+		return
+	}
+	req.info.Dispatched = time.Now()
+	s.opts.Observer.RequestDispatched(req.info)
+}
+
+func (s *NbdServer) observeCompleted(req *Request, err error) {
+	if req.info == nil {
+		return
+	}
+	req.info.Completed = time.Now()
+	req.info.Err = err
+	s.opts.Observer.RequestCompleted(req.info)
+}
+
+func (s *NbdServer) observeSent(reply *Reply) {
+	if reply.info == nil {
+		return
+	}
+	reply.info.Sent = time.Now()
+	s.opts.Observer.ReplySent(reply.info)
+}
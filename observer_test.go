@@ -0,0 +1,154 @@
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// recordingObserver records the calls made for each request.
+type recordingObserver struct {
+	lock  sync.Mutex
+	calls map[uint64][]string
+	infos map[uint64]*RequestInfo
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{
+		calls: make(map[uint64][]string),
+		infos: make(map[uint64]*RequestInfo),
+	}
+}
+
+func (o *recordingObserver) record(call string, info *RequestInfo) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.calls[info.Handle] = append(o.calls[info.Handle], call)
+	o.infos[info.Handle] = info
+}
+
+func (o *recordingObserver) RequestReceived(info *RequestInfo)   { o.record("received", info) }
+func (o *recordingObserver) RequestDispatched(info *RequestInfo) { o.record("dispatched", info) }
+func (o *recordingObserver) RequestCompleted(info *RequestInfo)  { o.record("completed", info) }
+func (o *recordingObserver) ReplySent(info *RequestInfo)         { o.record("sent", info) }
+
+func TestObserver(t *testing.T) {
+	obs := newRecordingObserver()
+	dev := &failingDevice{memDevice: newMemDevice(1 << 20), err: errors.New("broken")}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{Observer: obs})
+	c := startServer(t, s, k)
+
+	c.read(1, 4096, 8192)
+	c.send(nbdCmdWrite, 2, 0, 4096, pattern(4096, 1))
+	c.reply(0)
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	want := "[received dispatched completed sent]"
+	for h := uint64(1); h <= 2; h++ {
+		if got := fmt.Sprint(obs.calls[h]); got != want {
+			t.Errorf("got calls %s for request %d, want %s", got, h, want)
+		}
+	}
+	info := obs.infos[1]
+	if info.Command != CmdRead || info.Offset != 4096 || info.Length != 8192 || info.Err != nil {
+		t.Errorf("got read info %+v", info)
+	}
+	if info.Dispatched.Before(info.Received) || info.Completed.Before(info.Dispatched) || info.Sent.Before(info.Completed) {
+		t.Errorf("read stages are out of order: %+v", info)
+	}
+	if info := obs.infos[2]; info.Err == nil {
+		t.Error("failed write has no error")
+	}
+}
+
+func TestSpanExport(t *testing.T) {
+	var out bytes.Buffer
+	exp := NewJSONSpanExporter(&out)
+	dev := &failingDevice{memDevice: newMemDevice(1 << 20), err: errors.New("broken")}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{Observer: NewSpanObserver(exp)})
+	c := startServer(t, s, k)
+
+	c.read(1, 4096, 4096)
+	c.send(nbdCmdWrite, 2, 0, 4096, pattern(4096, 1))
+	c.reply(0)
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Attributes   []struct {
+			Key   string            `json:"key"`
+			Value map[string]string `json:"value"`
+		} `json:"attributes"`
+		Status struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"status"`
+	}
+	var traces [][]span
+	// Replies have all been sent once the server has stopped.
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Scope struct{ Name string }
+					Spans []span
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			t.Fatal(err)
+		}
+		scope := req.ResourceSpans[0].ScopeSpans[0]
+		if scope.Scope.Name != spanScopeName {
+			t.Errorf("got scope %q, want %q", scope.Scope.Name, spanScopeName)
+		}
+		traces = append(traces, scope.Spans)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("got %d traces, want 2", len(traces))
+	}
+
+	for i, spans := range traces {
+		if len(spans) != 4 {
+			t.Fatalf("trace %d has %d spans, want 4", i, len(spans))
+		}
+		root := spans[0]
+		for _, sp := range spans[1:] {
+			if sp.TraceID != root.TraceID || sp.ParentSpanID != root.SpanID {
+				t.Errorf("span %q isn't a child of the root span", sp.Name)
+			}
+		}
+		names := []string{root.Name, spans[1].Name, spans[2].Name, spans[3].Name}
+		wantNames := []string{"nbd." + []string{"Read", "Write"}[i], "queue", "backend", "reply"}
+		if fmt.Sprint(names) != fmt.Sprint(wantNames) {
+			t.Errorf("got spans %v, want %v", names, wantNames)
+		}
+		var handle string
+		for _, a := range root.Attributes {
+			if a.Key == "nbd.handle" {
+				handle = a.Value["intValue"]
+			}
+		}
+		if want := []string{"1", "2"}[i]; handle != want {
+			t.Errorf("trace %d has handle %q, want %q", i, handle, want)
+		}
+	}
+	if st := traces[0][0].Status.Code; st != spanStatusOk {
+		t.Errorf("successful read has status %d", st)
+	}
+	if st := traces[1][0].Status; st.Code != spanStatusError || st.Message != "broken" {
+		t.Errorf("failed write has status %+v", st)
+	}
+}
@@ -0,0 +1,140 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultMaxPause is the default for BlockDeviceOptions.MaxPause. It is
+	// well below the kernel's default request timeout of 30 seconds.
+	DefaultMaxPause = 10 * time.Second
+)
+
+var (
+	ErrPaused = errors.New("nbd: already paused")
+	// ErrResumed is returned by Pause if Resume or Disconnect is called before
+	// the pause has taken effect.
+	ErrResumed = errors.New("nbd: resumed while pausing")
+)
+
+// Pause stops requests from being performed, and waits for in-flight
+// requests to complete and the block device to be flushed, after which the
+// block device is consistent and unchanging until Resume is called. New
+// requests are left in the socket. If ctx is done first, or the flush fails,
+// requests are resumed and an error is returned.
+//
+// Requests are resumed automatically after BlockDeviceOptions.MaxPause, so
+// that the kernel doesn't time them out. Disconnect also resumes requests.
+func (s *NbdServer) Pause(ctx context.Context) error {
+	err := s.pause(ctx)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("nbd: paused")
+	s.sendEvent(Event{Type: EventPaused})
+	return nil
+}
+
+func (s *NbdServer) pause(ctx context.Context) error {
+	s.pauseLock.Lock()
+	if s.pauseTimer != nil || s.pauseCancel != nil {
+		s.pauseLock.Unlock()
+		return ErrPaused
+	}
+	// Waiting for requests can take a while, so is done without the lock.
+	// Resume cancels the pause until it takes effect.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	s.pauseCancel = cancel
+	s.pauseLock.Unlock()
+
+	start := time.Now()
+	err := s.quiesce.pause(ctx)
+	if err == nil {
+		err = s.flushPaused()
+		if err != nil {
+			s.quiesce.resume()
+		}
+	}
+
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	s.pauseCancel = nil
+	if err == nil && ctx.Err() != nil {
+		s.quiesce.resume()
+		err = ctx.Err()
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return cause
+		}
+		return err
+	}
+
+	maxPause := s.opts.MaxPause
+	if maxPause == 0 {
+		maxPause = DefaultMaxPause
+	}
+	s.pauseGen++
+	gen := s.pauseGen
+	s.pauseTimer = time.AfterFunc(maxPause-time.Since(start), func() {
+		if s.resume(gen) {
+			s.logger.Warn("nbd: resuming after maximum pause", "max_pause", maxPause)
+			s.sendEvent(Event{Type: EventResumed})
+		}
+	})
+	return nil
+}
+
+// flushPaused flushes the block device, once requests have been paused.
+func (s *NbdServer) flushPaused() error {
+	s.backendLock.Lock()
+	f, ok := s.block.(BlockDeviceFlusher)
+	s.backendLock.Unlock()
+	if !ok {
+		return nil
+	}
+	err := s.guard(f.Flush)
+	if err != nil {
+		s.logger.Error("nbd: error flushing block device on pause", "error", err)
+	}
+	return err
+}
+
+// Resume continues performing requests after Pause. If Pause is still
+// waiting for requests to complete, it is cancelled and returns ErrResumed.
+// Otherwise, it does nothing if not paused.
+func (s *NbdServer) Resume() {
+	if s.resume(0) {
+		s.logger.Info("nbd: resumed")
+		s.sendEvent(Event{Type: EventResumed})
+	}
+}
+
+// resume ends the pause, if paused, or cancels a pause which hasn't taken
+// effect yet. If gen is non-zero, the pause is only ended if it is that
+// generation. Returns true if a pause was ended.
+func (s *NbdServer) resume(gen uint64) bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if gen == 0 && s.pauseCancel != nil {
+		s.pauseCancel(ErrResumed)
+		return false
+	}
+	if s.pauseTimer == nil || (gen != 0 && gen != s.pauseGen) {
+		return false
+	}
+	s.pauseTimer.Stop()
+	s.pauseTimer = nil
+	s.quiesce.resume()
+	return true
+}
+
+// Paused returns true if requests are paused by Pause.
+func (s *NbdServer) Paused() bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	return s.pauseTimer != nil
+}
@@ -0,0 +1,173 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// pauseResult runs Pause in the background.
+func pauseResult(s *NbdServer) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- s.Pause(context.Background()) }()
+	return ch
+}
+
+// waitPausing waits until s is waiting for requests to complete in Pause.
+func waitPausing(t *testing.T, s *NbdServer) {
+	t.Helper()
+	waitFor(t, "Pause to wait for requests", func() bool {
+		s.quiesce.lock.Lock()
+		defer s.quiesce.lock.Unlock()
+		return s.quiesce.drained != nil
+	})
+}
+
+// returnsQuickly checks that f returns without waiting for requests.
+func returnsQuickly(t *testing.T, name string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s blocked while pausing", name)
+	}
+}
+
+func TestPause(t *testing.T) {
+	dev := newGatedDevice(1 << 20)
+	events := make(chan EventType, 4)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ConcurrentOps: 4,
+		OnEvent: func(ev Event) {
+			if ev.Type == EventPaused || ev.Type == EventResumed {
+				events <- ev.Type
+			}
+		},
+	})
+	c := startServer(t, s, k)
+
+	c.send(nbdCmdWrite, 1, 0, 4096, pattern(4096, 1))
+	dev.expectStart(t, 0)
+	paused := pauseResult(s)
+	waitPausing(t, s)
+
+	// The server can be inspected while Pause waits.
+	returnsQuickly(t, "Stats", func() { s.Stats() })
+	returnsQuickly(t, "Paused", func() {
+		if s.Paused() {
+			t.Error("Paused returned true before the pause took effect")
+		}
+	})
+	if err := s.Pause(context.Background()); err != ErrPaused {
+		t.Errorf("second Pause returned %v, want ErrPaused", err)
+	}
+
+	// Pause returns once the write has completed and the device is flushed.
+	dev.release(t, 0)
+	c.reply(0)
+	dev.expectStart(t, -1)
+	dev.release(t, -1)
+	if err := <-paused; err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if !s.Paused() || !s.Stats().Paused {
+		t.Error("not paused after Pause returned")
+	}
+
+	c.send(nbdCmdWrite, 2, 4096, 4096, pattern(4096, 2))
+	dev.expectNoStart(t)
+	s.Resume()
+	dev.expectStart(t, 4096)
+	dev.release(t, 4096)
+	c.reply(0)
+	if s.Paused() {
+		t.Error("paused after Resume")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if ev := <-events; ev != EventPaused {
+		t.Errorf("got event %v, want %v", ev, EventPaused)
+	}
+	if ev := <-events; ev != EventResumed {
+		t.Errorf("got event %v, want %v", ev, EventResumed)
+	}
+}
+
+func TestResumeWhilePausing(t *testing.T) {
+	dev := newGatedDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 4})
+	c := startServer(t, s, k)
+
+	c.send(nbdCmdWrite, 1, 0, 4096, pattern(4096, 1))
+	dev.expectStart(t, 0)
+	paused := pauseResult(s)
+	waitPausing(t, s)
+
+	// Resume cancels the pause without waiting for the write.
+	returnsQuickly(t, "Resume", s.Resume)
+	select {
+	case err := <-paused:
+		if !errors.Is(err, ErrResumed) {
+			t.Errorf("Pause returned %v, want ErrResumed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Pause didn't return after Resume")
+	}
+	if s.Paused() {
+		t.Error("paused after Resume")
+	}
+	c.send(nbdCmdRead, 2, 8192, 4096, nil)
+	dev.expectStart(t, 8192)
+	dev.release(t, 8192)
+	if code, h, _ := c.reply(4096); code != 0 || h != 2 {
+		t.Errorf("got reply with code %d for handle %d, want 0, 2", code, h)
+	}
+	dev.release(t, 0)
+	if code, h, _ := c.reply(0); code != 0 || h != 1 {
+		t.Errorf("got reply with code %d for handle %d, want 0, 1", code, h)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestDisconnectWhilePausing(t *testing.T) {
+	dev := newGatedDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+
+	c.send(nbdCmdWrite, 1, 0, 4096, pattern(4096, 1))
+	dev.expectStart(t, 0)
+	paused := pauseResult(s)
+	waitPausing(t, s)
+
+	returnsQuickly(t, "Disconnect", func() { s.Disconnect() })
+	if err := <-paused; !errors.Is(err, ErrResumed) {
+		t.Errorf("Pause returned %v, want ErrResumed", err)
+	}
+	dev.release(t, 0)
+	if err := c.wait(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestMaxPause(t *testing.T) {
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{MaxPause: 20 * time.Millisecond})
+	c := startServer(t, s, k)
+
+	if err := s.Pause(context.Background()); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	waitFor(t, "the pause to end", func() bool { return !s.Paused() })
+	c.read(1, 0, 4096)
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
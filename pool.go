@@ -0,0 +1,197 @@
+package nbd
+
+import (
+	"context"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Buffers are pooled in power-of-two size classes, from 512 bytes to 32MiB
+	// (the largest request the kernel will send). Larger buffers are not pooled.
+	minSizeClassShift = 9
+	maxSizeClassShift = 25
+)
+
+// BufferStats describes the buffer usage of a NbdServer.
+type BufferStats struct {
+	// PoolHits is the number of buffers which were reused from the pool.
+	PoolHits uint64
+	// PoolAllocs is the number of buffers which had to be allocated.
+	PoolAllocs uint64
+
+	// InFlightBytes is the number of request and reply data bytes currently
+	// in use.
+	InFlightBytes int64
+	// MaxInFlightBytes is the limit on InFlightBytes, or 0 if unlimited. For
+	// a device in a Manager with a MaxInFlightBytes, it is the manager's limit,
+	// which is shared with the other devices.
+	MaxInFlightBytes int64
+	// Waits is the number of times receiving a request was delayed because
+	// MaxInFlightBytes was reached.
+	Waits uint64
+}
+
+func sizeClass(size int) int {
+	if size <= 1<<minSizeClassShift {
+		return minSizeClassShift
+	}
+	shift := bits.Len(uint(size - 1))
+	if shift > maxSizeClassShift {
+		return -1
+	}
+	return shift
+}
+
+// bufferPool is a pool of byte buffers in power-of-two size classes. Each
+// buffer has an additional extra bytes of capacity, for headers.
+type bufferPool struct {
+	extra   int
+	classes [maxSizeClassShift + 1]sync.Pool
+
+	hits   atomic.Uint64
+	allocs atomic.Uint64
+}
+
+func newBufferPool(extra int) *bufferPool {
+	return &bufferPool{extra: extra}
+}
+
+// get returns a buffer with length size+extra.
+func (p *bufferPool) get(size int) *[]byte {
+	shift := sizeClass(size)
+	if shift < 0 {
+		p.allocs.Add(1)
+		b := make([]byte, size+p.extra)
+		return &b
+	}
+
+	b, ok := p.classes[shift].Get().(*[]byte)
+	if ok {
+		p.hits.Add(1)
+	} else {
+		p.allocs.Add(1)
+		buf := make([]byte, (1<<shift)+p.extra)
+		b = &buf
+	}
+	*b = (*b)[:size+p.extra]
+	return b
+}
+
+func (p *bufferPool) put(b *[]byte) {
+	size := cap(*b) - p.extra
+	shift := sizeClass(size)
+	if shift < 0 || size != 1<<shift {
+		return
+	}
+	p.classes[shift].Put(b)
+}
+
+// memLimiter limits the number of bytes reserved at any time. A nil
+// memLimiter, or one with a limit of 0, is unlimited. A memLimiter with a
+// parent has no limit of its own, but counts the bytes reserved through it
+// from the parent, which is shared with other servers.
+type memLimiter struct {
+	limit  int64
+	parent *memLimiter
+
+	lock  sync.Mutex
+	cond  sync.Cond
+	inUse int64
+	waits uint64
+}
+
+func newMemLimiter(limit int64) *memLimiter {
+	l := &memLimiter{limit: limit}
+	l.cond.L = &l.lock
+	return l
+}
+
+// child returns a memLimiter which reserves from l.
+func (l *memLimiter) child() *memLimiter {
+	c := newMemLimiter(0)
+	c.parent = l
+	return c
+}
+
+// reserve blocks until n bytes can be reserved, or ctx is done. A reservation
+// which exceeds the limit is allowed when nothing else is reserved, to avoid
+// deadlock.
+func (l *memLimiter) reserve(ctx context.Context, n int64) error {
+	if l == nil || n == 0 {
+		return nil
+	}
+	if l.parent == nil {
+		_, err := l.take(ctx, n)
+		return err
+	}
+	waited, err := l.parent.take(ctx, n)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	l.inUse += n
+	if waited {
+		l.waits++
+	}
+	l.lock.Unlock()
+	return nil
+}
+
+// take reserves n bytes from l, and returns whether it had to wait.
+func (l *memLimiter) take(ctx context.Context, n int64) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	waited := false
+	if l.limit > 0 && l.inUse > 0 && l.inUse+n > l.limit {
+		waited = true
+		l.waits++
+		// Taking the lock ensures the waiter is either waiting, or yet to check
+		// ctx, when it is woken.
+		stop := context.AfterFunc(ctx, func() {
+			l.lock.Lock()
+			l.cond.Broadcast()
+			l.lock.Unlock()
+		})
+		defer stop()
+		for l.inUse > 0 && l.inUse+n > l.limit {
+			if err := ctx.Err(); err != nil {
+				return waited, err
+			}
+			l.cond.Wait()
+		}
+	}
+	l.inUse += n
+	return waited, nil
+}
+
+func (l *memLimiter) release(n int64) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.lock.Lock()
+	l.inUse -= n
+	l.lock.Unlock()
+	if l.parent != nil {
+		l.parent.release(n)
+		return
+	}
+	l.cond.Broadcast()
+}
+
+func (l *memLimiter) stats(s *BufferStats) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s.InFlightBytes = l.inUse
+	s.MaxInFlightBytes = l.limit
+	s.Waits = l.waits
+	if l.parent != nil {
+		l.parent.lock.Lock()
+		s.MaxInFlightBytes = l.parent.limit
+		l.parent.lock.Unlock()
+	}
+}
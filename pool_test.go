@@ -0,0 +1,118 @@
+package nbd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemLimiterReserve(t *testing.T) {
+	l := newMemLimiter(8192)
+	ctx := context.Background()
+	if err := l.reserve(ctx, 8192); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- l.reserve(ctx, 4096) }()
+	select {
+	case <-done:
+		t.Fatal("reserved beyond the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.release(4096)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("reserve didn't return after release")
+	}
+
+	var st BufferStats
+	l.stats(&st)
+	if st.InFlightBytes != 8192 || st.Waits != 1 {
+		t.Errorf("got %d bytes in use after %d waits, want 8192 after 1", st.InFlightBytes, st.Waits)
+	}
+}
+
+func TestMemLimiterReserveCancel(t *testing.T) {
+	l := newMemLimiter(4096)
+	if err := l.reserve(context.Background(), 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- l.reserve(ctx, 4096) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("reserve returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("reserve didn't return after cancel")
+	}
+
+	var st BufferStats
+	l.stats(&st)
+	if st.InFlightBytes != 4096 {
+		t.Errorf("got %d bytes in use, want 4096", st.InFlightBytes)
+	}
+}
+
+func TestMemLimiterChild(t *testing.T) {
+	parent := newMemLimiter(8192)
+	a, b := parent.child(), parent.child()
+	ctx := context.Background()
+	if err := a.reserve(ctx, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.reserve(ctx, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// The children share the parent's limit.
+	done := make(chan error, 1)
+	go func() { done <- b.reserve(ctx, 4096) }()
+	select {
+	case <-done:
+		t.Fatal("reserved beyond the parent's limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	a.release(4096)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("reserve didn't return after release")
+	}
+
+	// Each child counts only its own bytes and waits.
+	var ast, bst BufferStats
+	a.stats(&ast)
+	b.stats(&bst)
+	if ast != (BufferStats{MaxInFlightBytes: 8192}) {
+		t.Errorf("got stats %+v for a, want nothing in use", ast)
+	}
+	if bst != (BufferStats{InFlightBytes: 8192, MaxInFlightBytes: 8192, Waits: 1}) {
+		t.Errorf("got stats %+v for b, want 8192 bytes in use after 1 wait", bst)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(0)
+	b := p.get(3000)
+	if len(*b) != 3000 || cap(*b) != 4096 {
+		t.Errorf("got buffer of length %d and capacity %d, want 3000 and 4096", len(*b), cap(*b))
+	}
+	p.put(b)
+	if p.allocs.Load() != 1 {
+		t.Errorf("got %d allocations, want 1", p.allocs.Load())
+	}
+}
@@ -0,0 +1,134 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Privileges are the user, groups, and capabilities a process drops to once
+// the kernel has been set up. See BlockDeviceOptions.DropPrivileges.
+type Privileges struct {
+	Uid int
+	Gid int
+	// Groups are the supplementary groups. If empty, all are dropped.
+	Groups []int
+	// Capabilities to keep, such as unix.CAP_NET_BIND_SERVICE. All others are
+	// dropped. Keeping capabilities isn't supported in programs which use cgo.
+	Capabilities []int
+}
+
+// Validate checks that p can be dropped to, so that mistakes can be caught
+// before the kernel is set up, rather than by Drop.
+func (p Privileges) Validate() error {
+	if p.Uid <= 0 || p.Gid < 0 {
+		return errors.New("nbd: Privileges must have a non-root Uid and a valid Gid")
+	}
+	for _, c := range p.Capabilities {
+		if c < 0 || c >= 64 {
+			return fmt.Errorf("nbd: invalid capability %d", c)
+		}
+	}
+	return nil
+}
+
+// Drop changes the user and groups of every thread of the process to those
+// of p, and drops all capabilities not in p.Capabilities. It can be used as
+// BlockDeviceOptions.DropPrivileges.
+func (p Privileges) Drop() error {
+	err := p.Validate()
+	if err != nil {
+		return err
+	}
+	var caps [2]unix.CapUserData
+	for _, c := range p.Capabilities {
+		caps[c/32].Permitted |= 1 << (c % 32)
+	}
+	caps[0].Effective = caps[0].Permitted
+	caps[1].Effective = caps[1].Permitted
+
+	if len(p.Capabilities) > 0 {
+		// Keep permitted capabilities across the change of user.
+		err := allThreadsPrctl(unix.PR_SET_KEEPCAPS, 1)
+		if err != nil {
+			return fmt.Errorf("nbd: error keeping capabilities: %w", err)
+		}
+	}
+	err = syscall.Setgroups(p.Groups)
+	if err != nil {
+		return fmt.Errorf("nbd: error setting groups: %w", err)
+	}
+	err = syscall.Setgid(p.Gid)
+	if err != nil {
+		return fmt.Errorf("nbd: error setting gid: %w", err)
+	}
+	err = syscall.Setuid(p.Uid)
+	if err != nil {
+		return fmt.Errorf("nbd: error setting uid: %w", err)
+	}
+	if len(p.Capabilities) == 0 {
+		// Changing from root to another user clears all capabilities.
+		return nil
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&caps[0])), 0)
+	runtime.KeepAlive(&hdr)
+	runtime.KeepAlive(&caps)
+	if errno != 0 {
+		return fmt.Errorf("nbd: error setting capabilities: %w", errno)
+	}
+	err = allThreadsPrctl(unix.PR_SET_KEEPCAPS, 0)
+	if err != nil {
+		return fmt.Errorf("nbd: error keeping capabilities: %w", err)
+	}
+	return nil
+}
+
+func allThreadsPrctl(option, arg uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, option, arg, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropPrivileges calls the DropPrivileges hook, if set. It is called once the
+// kernel has been set up, which is the last thing which needs privileges.
+func (s *NbdServer) dropPrivileges() error {
+	if s.opts.DropPrivileges == nil {
+		return nil
+	}
+	err := s.opts.DropPrivileges()
+	if err != nil {
+		s.logger.Error("nbd: error dropping privileges", "error", err)
+		return err
+	}
+	s.privDropped.Store(true)
+	s.logger.Info("nbd: dropped privileges")
+	return nil
+}
+
+// shutdownSock ends the connection with the kernel from the server's side,
+// which the kernel treats as the server going away.
+func (s *NbdServer) shutdownSock() error {
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	if s.sock == nil {
+		return nil
+	}
+	s.shutdown.Store(true)
+	var err error
+	cerr := s.sock.Control(func(fd uintptr) {
+		err = unix.Shutdown(int(fd), unix.SHUT_RDWR)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package nbd
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDropPrivileges(t *testing.T) {
+	var drops atomic.Int32
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{
+		DropPrivileges: func() error {
+			drops.Add(1)
+			return nil
+		},
+	})
+	c := startServer(t, s, k)
+
+	waitFor(t, "privileges to be dropped", s.privDropped.Load)
+	c.read(1, 0, 4096)
+	if n := drops.Load(); n != 1 {
+		t.Fatalf("privileges dropped %d times, want 1", n)
+	}
+	// The kernel would refuse a netlink disconnect without privileges, so the
+	// server closes its end of the connection instead.
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if reqs := k.netlinkRequests(); len(reqs) != 1 || reqs[0].cmd != nbdNlCmdConnect {
+		t.Errorf("got netlink requests %+v, want only connect", reqs)
+	}
+}
+
+func TestDropPrivilegesFails(t *testing.T) {
+	dropErr := errors.New("no such user")
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{
+		DropPrivileges: func() error { return dropErr },
+	})
+	c := startServer(t, s, k)
+
+	// The device is disconnected, while still privileged.
+	if err := c.wait(); err != dropErr {
+		t.Errorf("Run returned %v, want %v", err, dropErr)
+	}
+	if reqs := k.netlinkRequests(); len(reqs) != 2 || reqs[1].cmd != nbdNlCmdDisconnect {
+		t.Errorf("got netlink requests %+v, want connect and disconnect", reqs)
+	}
+}
+
+func TestDropPrivilegesDoItFails(t *testing.T) {
+	var drops atomic.Int32
+	k := newFakeKernel(0)
+	k.doItErr = unix.EBUSY
+	s, err := newServerFromFd(k, -1, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{
+		Logger: testLogger(),
+		DropPrivileges: func() error {
+			drops.Add(1)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sysfs = "/sys/block/nbd5"
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run() }()
+	select {
+	case err := <-runErr:
+		if err != unix.EBUSY {
+			t.Errorf("Run returned %v, want EBUSY", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Run didn't return after NBD_DO_IT failed")
+	}
+	if n := drops.Load(); n != 0 {
+		t.Errorf("privileges dropped %d times, want 0", n)
+	}
+}
+
+func TestPrivilegesValidate(t *testing.T) {
+	for _, p := range []Privileges{
+		{Uid: 0, Gid: 1000},
+		{Uid: 1000, Gid: -1},
+		{Uid: 1000, Gid: 1000, Capabilities: []int{64}},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Validate succeeded with %+v", p)
+		}
+		if err := p.Drop(); err == nil {
+			t.Errorf("Drop succeeded with %+v", p)
+		}
+	}
+	p := Privileges{Uid: 1000, Gid: 1000, Capabilities: []int{unix.CAP_NET_BIND_SERVICE}}
+	if err := p.Validate(); err != nil {
+		t.Errorf("Validate failed with %+v: %v", p, err)
+	}
+}
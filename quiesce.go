@@ -0,0 +1,138 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errClosed = errors.New("nbd: connection closed")
+
+// quiescer stops new requests from being dispatched, and waits for dispatched
+// requests to complete. A request is active from when it is dispatched until
+// its reply has been sent.
+type quiescer struct {
+	lock   sync.Mutex
+	active int
+	pauses int
+
+	// Closed when the connection is closed.
+	closed chan struct{}
+
+	// Closed when the last pause ends, or the connection is closed. Nil if not
+	// paused.
+	resumed chan struct{}
+	// Closed when there are no active requests while paused, or the connection
+	// is closed.
+	drained chan struct{}
+}
+
+func newQuiescer() *quiescer {
+	return &quiescer{closed: make(chan struct{})}
+}
+
+// enter waits until requests aren't paused, and marks a request as active.
+func (q *quiescer) enter(ctx context.Context) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.pauses > 0 && !q.isClosed() {
+		resumed := q.resumed
+		q.lock.Unlock()
+		select {
+		case <-resumed:
+		case <-q.closed:
+		case <-ctx.Done():
+			q.lock.Lock()
+			return ctx.Err()
+		}
+		q.lock.Lock()
+	}
+	if q.isClosed() {
+		return errClosed
+	}
+	q.active++
+	return nil
+}
+
+func (q *quiescer) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// exit marks a request as no longer active.
+func (q *quiescer) exit() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.active == 0 {
+		// The request was active before close.
+		return
+	}
+	q.active--
+	if q.active == 0 && q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+}
+
+// pause stops requests being dispatched, and waits for active requests to
+// complete. Unless an error is returned, resume must be called to allow
+// requests to continue.
+func (q *quiescer) pause(ctx context.Context) error {
+	q.lock.Lock()
+	q.pauses++
+	if q.pauses == 1 {
+		q.resumed = make(chan struct{})
+	}
+	if q.active == 0 || q.isClosed() {
+		q.lock.Unlock()
+		return nil
+	}
+	if q.drained == nil {
+		q.drained = make(chan struct{})
+	}
+	ch := q.drained
+	q.lock.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		q.resume()
+		return ctx.Err()
+	}
+}
+
+// resume ends a pause.
+func (q *quiescer) resume() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.pauses == 0 {
+		return
+	}
+	q.pauses--
+	if q.pauses == 0 {
+		close(q.resumed)
+		q.resumed = nil
+	}
+}
+
+// close stops requests from being entered, forgets active requests, which
+// might never complete, and wakes any waiters. It is called when the
+// connection is being closed.
+func (q *quiescer) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.isClosed() {
+		return
+	}
+	close(q.closed)
+	q.active = 0
+	if q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+}
@@ -0,0 +1,146 @@
+package nbd
+
+import (
+	"sync"
+)
+
+// rangeLocker orders requests which conflict with each other. Requests are
+// added in the order they are received, and each waits for earlier
+// conflicting requests to be released before being performed.
+//
+// If overlapping is set, requests with overlapping ranges conflict unless
+// they are both reads. If flushBarrier is set, flushes conflict with all
+// writes.
+type rangeLocker struct {
+	overlapping  bool
+	flushBarrier bool
+
+	lock   sync.Mutex
+	active []*rangeEntry
+}
+
+type rangeEntry struct {
+	start, end uint64
+	write      bool
+	flush      bool
+
+	// Number of earlier entries this entry is waiting for, and the later
+	// entries waiting for this one. Protected by rangeLocker.lock.
+	pending    int
+	dependents []*rangeEntry
+
+	ready chan struct{}
+}
+
+func newRangeLocker(overlapping, flushBarrier bool) *rangeLocker {
+	return &rangeLocker{
+		overlapping:  overlapping,
+		flushBarrier: flushBarrier,
+	}
+}
+
+func (l *rangeLocker) conflicts(e, a *rangeEntry) bool {
+	if e.flush || a.flush {
+		return l.flushBarrier && (e.write || a.write)
+	}
+	return l.overlapping && (e.write || a.write) && e.start < a.end && a.start < e.end
+}
+
+// add registers req, which must be done in the order requests are received.
+func (l *rangeLocker) add(req *Request) {
+	if l == nil {
+		return
+	}
+	var write, flush bool
+	switch req.cmd {
+	case nbdCmdRead:
+		if !l.overlapping {
+			return
+		}
+	case nbdCmdWrite, nbdCmdTrim, nbdCmdWriteZeroes:
+		write = true
+	case nbdCmdFlush:
+		if !l.flushBarrier {
+			return
+		}
+		flush = true
+	default:
+		return
+	}
+	if req.length == 0 && !flush {
+		return
+	}
+
+	e := &rangeEntry{
+		start: req.offset,
+		end:   req.offset + uint64(req.length),
+		write: write,
+		flush: flush,
+		ready: make(chan struct{}),
+	}
+
+	l.lock.Lock()
+	for _, a := range l.active {
+		if l.conflicts(e, a) {
+			e.pending++
+			a.dependents = append(a.dependents, e)
+		}
+	}
+	l.active = append(l.active, e)
+	if e.pending == 0 {
+		close(e.ready)
+	}
+	l.lock.Unlock()
+
+	req.rl = e
+}
+
+// release unblocks requests waiting for req.
+func (l *rangeLocker) release(req *Request) {
+	e := req.rl
+	if l == nil || e == nil {
+		return
+	}
+	req.rl = nil
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, a := range l.active {
+		if a == e {
+			last := len(l.active) - 1
+			l.active[i] = l.active[last]
+			l.active[last] = nil
+			l.active = l.active[:last]
+			break
+		}
+	}
+	for _, d := range e.dependents {
+		d.pending--
+		if d.pending == 0 {
+			close(d.ready)
+		}
+	}
+}
+
+// waitChan returns a channel which is closed once req may be performed, or
+// nil if req isn't ordered.
+func (req *Request) waitChan() <-chan struct{} {
+	if req.rl == nil {
+		return nil
+	}
+	return req.rl.ready
+}
+
+// mayPerform returns true if req doesn't have to wait for earlier requests.
+func (req *Request) mayPerform() bool {
+	ch := req.waitChan()
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,150 @@
+package nbd
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderOverlapping(t *testing.T) {
+	dev := newGatedDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 8, OrderOverlapping: true})
+	c := startServer(t, s, k)
+
+	first, second, third := pattern(8192, 1), pattern(4096, 2), pattern(4096, 3)
+	c.send(nbdCmdWrite, 1, 0, 8192, first)
+	dev.expectStart(t, 0)
+
+	// Overlapping requests wait for the first write, even though workers are
+	// free, and then for each other.
+	c.send(nbdCmdWrite, 2, 4096, 4096, second)
+	c.send(nbdCmdRead, 3, 4096, 4096, nil)
+	c.send(nbdCmdWrite, 4, 4096, 4096, third)
+	dev.expectNoStart(t)
+
+	// Requests which don't overlap aren't held up.
+	c.send(nbdCmdRead, 5, 65536, 4096, nil)
+	dev.expectStart(t, 65536)
+	dev.release(t, 65536)
+	if code, h, _ := c.reply(4096); code != 0 || h != 5 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 5", code, h)
+	}
+
+	dev.release(t, 0)
+	if code, h, _ := c.reply(0); code != 0 || h != 1 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 1", code, h)
+	}
+	dev.expectStart(t, 4096)
+	dev.expectNoStart(t)
+	dev.release(t, 4096)
+	if code, h, _ := c.reply(0); code != 0 || h != 2 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 2", code, h)
+	}
+	dev.expectStart(t, 4096)
+	dev.expectNoStart(t)
+	dev.release(t, 4096)
+	if code, h, data := c.reply(4096); code != 0 || h != 3 || string(data) != string(second) {
+		t.Fatalf("got reply with code %d for handle %d, want the second write's data for handle 3", code, h)
+	}
+	dev.expectStart(t, 4096)
+	dev.release(t, 4096)
+	if code, h, _ := c.reply(0); code != 0 || h != 4 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 4", code, h)
+	}
+
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if string(dev.data[:8192]) != string(first[:4096])+string(third) {
+		t.Error("overlapping writes were performed out of order")
+	}
+}
+
+func TestOrderOverlappingSplice(t *testing.T) {
+	const size = 8 << 20
+	dev := newFileDevice(t, size)
+	s, k := newTestServer(t, dev, size, BlockDeviceOptions{ConcurrentOps: 1, OrderOverlapping: true})
+	c := startServer(t, s, k)
+
+	old, data := pattern(4096, 1), pattern(4096, 2)
+	c.write(1, 0, old)
+
+	// The large read fills the socket, so the spliced read's data stays in its
+	// pipe, which shares the file's pages. The overlapping write must wait
+	// until that data has been sent.
+	c.send(nbdCmdRead, 2, 1<<20, 4<<20, nil)
+	c.send(nbdCmdRead, 3, 0, 4096, nil)
+	c.send(nbdCmdWrite, 4, 0, 4096, data)
+	time.Sleep(50 * time.Millisecond)
+
+	if code, h, _ := c.reply(4 << 20); code != 0 || h != 2 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 2", code, h)
+	}
+	if code, h, got := c.reply(4096); code != 0 || h != 3 || string(got) != string(old) {
+		t.Fatalf("got reply with code %d for handle %d, want the old data for handle 3", code, h)
+	}
+	if code, h, _ := c.reply(0); code != 0 || h != 4 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 4", code, h)
+	}
+	if got := c.read(5, 0, 4096); string(got) != string(data) {
+		t.Error("read after the write didn't return its data")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+// opLog is a memDevice which records the order of writes and flushes.
+type opLog struct {
+	*memDevice
+	lock sync.Mutex
+	ops  []string
+}
+
+func (d *opLog) record(op string) {
+	d.lock.Lock()
+	d.ops = append(d.ops, op)
+	d.lock.Unlock()
+}
+
+func (d *opLog) WriteAt(b []byte, off int64) (int, error) {
+	d.record(fmt.Sprintf("write %d", off))
+	return d.memDevice.WriteAt(b, off)
+}
+
+func (d *opLog) Flush() error {
+	d.record("flush")
+	return d.memDevice.Flush()
+}
+
+func TestFlushBarrierThrottled(t *testing.T) {
+	dev := &opLog{memDevice: newMemDevice(1 << 20)}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ConcurrentOps: 1,
+		FlushBarrier:  true,
+		RateLimits:    RateLimits{WriteIOPS: 10, Burst: 100 * time.Millisecond},
+	})
+	c := startServer(t, s, k)
+
+	// The flush isn't limited, but must not take the only worker while the
+	// writes before it are throttled.
+	for i := 0; i < 3; i++ {
+		c.send(nbdCmdWrite, uint64(i), uint64(i)*4096, 4096, pattern(4096, byte(i)))
+	}
+	c.send(nbdCmdFlush, 3, 0, 0, nil)
+	c.send(nbdCmdWrite, 4, 65536, 4096, pattern(4096, 4))
+	for i := uint64(0); i <= 4; i++ {
+		if code, h, _ := c.reply(0); code != 0 || h != i {
+			t.Fatalf("got reply with code %d for handle %d, want 0, %d", code, h, i)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	want := []string{"write 0", "write 4096", "write 8192", "flush", "write 65536"}
+	if fmt.Sprint(dev.ops) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", dev.ops, want)
+	}
+}
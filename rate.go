@@ -0,0 +1,183 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRateBurst is the default for RateLimits.Burst.
+	DefaultRateBurst = time.Second
+)
+
+// RateLimits limits the rate at which requests are performed. Limits which
+// are 0 are unlimited. Reads count towards the read limits. Writes and trims
+// count towards the write IOPS limit, and the data of writes towards the
+// write bandwidth limit. Flushes aren't limited.
+type RateLimits struct {
+	ReadIOPS         float64
+	WriteIOPS        float64
+	ReadBytesPerSec  float64
+	WriteBytesPerSec float64
+
+	// Burst is how much unused allowance can accumulate, as a duration of
+	// each limit. A device which has been idle can exceed its limits until the
+	// allowance has been used. If 0, DefaultRateBurst is used.
+	Burst time.Duration
+}
+
+func (l *RateLimits) validate() error {
+	if l.ReadIOPS < 0 || l.WriteIOPS < 0 || l.ReadBytesPerSec < 0 || l.WriteBytesPerSec < 0 {
+		return errors.New("nbd: rate limits must be non-negative")
+	}
+	if l.Burst < 0 {
+		return errors.New("nbd: rate limit Burst must be non-negative")
+	}
+	return nil
+}
+
+func (l *RateLimits) limited() bool {
+	return l.ReadIOPS > 0 || l.WriteIOPS > 0 || l.ReadBytesPerSec > 0 || l.WriteBytesPerSec > 0
+}
+
+// tokenBucket is a token bucket which can go into debt, so that a request can
+// be scheduled as soon as it arrives.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(now time.Time, rate float64, burst time.Duration) {
+	wasLimited := b.rate > 0
+	b.fill(now)
+	b.rate = rate
+	b.burst = rate * burst.Seconds()
+	if wasLimited {
+		b.tokens = min(b.tokens, b.burst)
+	} else {
+		// Start with a full bucket.
+		b.tokens = b.burst
+	}
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// take takes n tokens, and returns how long until the bucket is out of debt.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.fill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter schedules requests according to RateLimits.
+type rateLimiter struct {
+	enabled atomic.Bool
+
+	lock       sync.Mutex
+	limits     RateLimits
+	readOps    tokenBucket
+	writeOps   tokenBucket
+	readBytes  tokenBucket
+	writeBytes tokenBucket
+
+	throttled     atomic.Uint64
+	throttledTime atomic.Int64
+}
+
+func (rl *rateLimiter) setLimits(l RateLimits) {
+	burst := l.Burst
+	if burst == 0 {
+		burst = DefaultRateBurst
+	}
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.limits = l
+	rl.readOps.setRate(now, l.ReadIOPS, burst)
+	rl.writeOps.setRate(now, l.WriteIOPS, burst)
+	rl.readBytes.setRate(now, l.ReadBytesPerSec, burst)
+	rl.writeBytes.setRate(now, l.WriteBytesPerSec, burst)
+	rl.enabled.Store(l.limited())
+}
+
+func (rl *rateLimiter) getLimits() RateLimits {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.limits
+}
+
+// schedule returns the time req can be performed without exceeding the
+// limits, or the zero time if it can be performed immediately.
+func (rl *rateLimiter) schedule(req *Request) time.Time {
+	if !rl.enabled.Load() {
+		return time.Time{}
+	}
+	now := time.Now()
+	var delay time.Duration
+	rl.lock.Lock()
+	switch req.cmd {
+	case nbdCmdRead:
+		delay = max(rl.readOps.take(now, 1), rl.readBytes.take(now, float64(req.length)))
+	case nbdCmdWrite:
+		delay = max(rl.writeOps.take(now, 1), rl.writeBytes.take(now, float64(req.length)))
+	case nbdCmdTrim, nbdCmdWriteZeroes:
+		delay = rl.writeOps.take(now, 1)
+	}
+	rl.lock.Unlock()
+
+	if delay == 0 {
+		return time.Time{}
+	}
+	rl.throttled.Add(1)
+	rl.throttledTime.Add(int64(delay))
+	return now.Add(delay)
+}
+
+// waitThrottled waits until req can be performed without exceeding the rate
+// limits.
+func waitThrottled(ctx context.Context, req *Request) error {
+	d := time.Until(req.throttled)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetRateLimits changes the rate limits while the server is running. Requests
+// already waiting keep their schedule.
+func (s *NbdServer) SetRateLimits(l RateLimits) error {
+	err := l.validate()
+	if err != nil {
+		return err
+	}
+	s.limiter.setLimits(l)
+	return nil
+}
+
+// RateLimits returns the current rate limits.
+func (s *NbdServer) RateLimits() RateLimits {
+	return s.limiter.getLimits()
+}
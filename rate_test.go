@@ -0,0 +1,102 @@
+package nbd
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottledOrderedRequests(t *testing.T) {
+	dev := newMemDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ConcurrentOps:    1,
+		OrderOverlapping: true,
+		RateLimits:       RateLimits{ReadIOPS: 10, Burst: 100 * time.Millisecond},
+	})
+	c := startServer(t, s, k)
+
+	// The reads use up the burst, so that the second is throttled. The write
+	// must not take the only worker while waiting for the throttled read.
+	data := pattern(4096, 1)
+	c.send(nbdCmdRead, 1, 0, 4096, nil)
+	c.send(nbdCmdRead, 2, 0, 4096, nil)
+	c.send(nbdCmdRead, 3, 0, 4096, nil)
+	c.send(nbdCmdWrite, 4, 0, 4096, data)
+	for i := uint64(1); i <= 4; i++ {
+		length := 4096
+		if i == 4 {
+			length = 0
+		}
+		code, h, got := c.reply(length)
+		if code != 0 || h != i {
+			t.Fatalf("got reply with code %d for handle %d, want 0, %d", code, h, i)
+		}
+		if i < 4 && string(got) != string(make([]byte, 4096)) {
+			t.Errorf("read %d returned data written after it", i)
+		}
+	}
+	if st := s.Stats(); st.Throttled == 0 {
+		t.Error("no requests were throttled")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	const n = 6
+	limits := RateLimits{WriteIOPS: 100, Burst: 10 * time.Millisecond}
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{ConcurrentOps: 4, RateLimits: limits})
+	c := startServer(t, s, k)
+
+	// Writes are limited, but reads aren't.
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		c.send(nbdCmdWrite, uint64(i), uint64(i)*4096, 4096, pattern(4096, 1))
+		c.send(nbdCmdRead, uint64(n+i), 0, 4096, nil)
+	}
+	var last uint64
+	for i := 0; i < 2*n; i++ {
+		code, h, _ := c.reply(0)
+		last = h
+		if h >= n {
+			c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+			if _, err := io.ReadFull(c.conn, make([]byte, 4096)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if code != 0 {
+			t.Fatalf("request %d failed with %d", h, code)
+		}
+	}
+	if last >= n {
+		t.Error("reads were held up by throttled writes")
+	}
+	if d := time.Since(start); d < (n-2)*10*time.Millisecond {
+		t.Errorf("%d writes took %v, faster than the limit", n, d)
+	}
+	st := s.Stats()
+	if st.Throttled < n-2 || st.ThrottledTime <= 0 {
+		t.Errorf("got %d requests throttled for %v, want at least %d", st.Throttled, st.ThrottledTime, n-2)
+	}
+	if st.RateLimits != limits {
+		t.Errorf("got limits %+v, want %+v", st.RateLimits, limits)
+	}
+
+	// Removing the limits takes effect for new requests.
+	if err := s.SetRateLimits(RateLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		c.write(uint64(i), 0, pattern(4096, 2))
+	}
+	if got := s.Stats().Throttled; got != st.Throttled {
+		t.Errorf("%d requests throttled without limits", got-st.Throttled)
+	}
+	if err := s.SetRateLimits(RateLimits{ReadIOPS: -1}); err == nil {
+		t.Error("SetRateLimits accepted a negative limit")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
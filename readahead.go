@@ -0,0 +1,213 @@
+package nbd
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// Number of consecutive sequential reads before read-ahead starts.
+	readAheadMinSequential = 2
+)
+
+// readAhead detects sequential reads and prefetches data following them into
+// a bounded cache.
+type readAhead struct {
+	s        *NbdServer
+	dev      BlockDevice
+	window   int
+	maxBytes int
+
+	// Prefetches in progress.
+	pending sync.WaitGroup
+
+	lock        sync.Mutex
+	nextOff     uint64
+	sequential  int
+	prefetchEnd uint64
+	segs        []*raSegment
+	bytes       int
+}
+
+// raSegment is a prefetched range of the device. data is valid once ready is
+// closed, unless err is set.
+type raSegment struct {
+	off   uint64
+	data  []byte
+	ready chan struct{}
+	err   error
+}
+
+func newReadAhead(s *NbdServer, dev BlockDevice, window, maxBytes int) *readAhead {
+	// Prefetching starts before the stream has consumed the previous window,
+	// so there needs to be space for both.
+	if maxBytes < 2*window {
+		maxBytes = 2 * window
+	}
+	return &readAhead{
+		s:        s,
+		dev:      dev,
+		window:   window,
+		maxBytes: maxBytes,
+	}
+}
+
+func (seg *raSegment) end() uint64 {
+	return seg.off + uint64(len(seg.data))
+}
+
+// observe is called with each request, in the order they are received. Reads
+// may start a prefetch, and writes invalidate cached data.
+func (ra *readAhead) observe(req *Request) {
+	if ra == nil {
+		return
+	}
+	switch req.cmd {
+	case nbdCmdRead:
+	case nbdCmdWrite, nbdCmdTrim, nbdCmdWriteZeroes:
+		ra.invalidate(req.offset, req.length)
+		return
+	default:
+		return
+	}
+
+	end := req.offset + uint64(req.length)
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	if req.offset == ra.nextOff {
+		ra.sequential++
+	} else {
+		ra.sequential = 0
+		ra.prefetchEnd = 0
+	}
+	ra.nextOff = end
+	if ra.sequential < readAheadMinSequential {
+		return
+	}
+	// Prefetches aren't charged to the rate limits, so they would read from
+	// the block device faster than allowed while reads are throttled.
+	if !req.throttled.IsZero() {
+		return
+	}
+
+	// Keep at least half a window prefetched ahead of the stream.
+	if ra.prefetchEnd > end+uint64(ra.window/2) {
+		return
+	}
+	off := max(ra.prefetchEnd, end)
+	length := min(uint64(ra.window), uint64(ra.s.size)-min(off, uint64(ra.s.size)))
+	if length == 0 {
+		return
+	}
+	seg := &raSegment{
+		off:   off,
+		data:  make([]byte, length),
+		ready: make(chan struct{}),
+	}
+	ra.addLocked(seg)
+	ra.prefetchEnd = seg.end()
+	ra.pending.Add(1)
+	go ra.prefetch(seg)
+}
+
+func (ra *readAhead) addLocked(seg *raSegment) {
+	ra.segs = append(ra.segs, seg)
+	ra.bytes += len(seg.data)
+	for ra.bytes > ra.maxBytes && len(ra.segs) > 1 {
+		ra.bytes -= len(ra.segs[0].data)
+		ra.segs[0] = nil
+		ra.segs = ra.segs[1:]
+	}
+}
+
+func (ra *readAhead) prefetch(seg *raSegment) {
+	defer ra.pending.Done()
+	seg.err = ra.s.guard(func() error {
+		n, err := ra.dev.ReadAt(seg.data, int64(seg.off))
+		if err == io.EOF && n == len(seg.data) {
+			err = nil
+		}
+		return err
+	})
+	close(seg.ready)
+}
+
+// read fills b from the cache, returning false if the data isn't cached.
+func (ra *readAhead) read(b []byte, off uint64) bool {
+	if ra == nil {
+		return false
+	}
+	end := off + uint64(len(b))
+	ra.lock.Lock()
+	var seg *raSegment
+	for _, s := range ra.segs {
+		if s.off <= off && end <= s.end() {
+			seg = s
+			break
+		}
+	}
+	if seg == nil {
+		ra.lock.Unlock()
+		ra.s.metrics.readAheadMisses.Add(1)
+		return false
+	}
+	ra.lock.Unlock()
+
+	<-seg.ready
+
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	// The segment may have been invalidated while waiting.
+	valid := seg.err == nil
+	if valid {
+		valid = false
+		for _, s := range ra.segs {
+			if s == seg {
+				valid = true
+				break
+			}
+		}
+	}
+	if !valid {
+		ra.s.metrics.readAheadMisses.Add(1)
+		return false
+	}
+	copy(b, seg.data[off-seg.off:])
+	ra.s.metrics.readAheadHits.Add(1)
+	return true
+}
+
+// invalidate removes cached data overlapping the given range. Segments still
+// being prefetched are also removed, since they may contain stale data.
+func (ra *readAhead) invalidate(off uint64, length uint32) {
+	if ra == nil {
+		return
+	}
+	end := off + uint64(length)
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	segs := ra.segs[:0]
+	for _, s := range ra.segs {
+		if s.off < end && off < s.end() {
+			ra.bytes -= len(s.data)
+			continue
+		}
+		segs = append(segs, s)
+	}
+	for i := len(segs); i < len(ra.segs); i++ {
+		ra.segs[i] = nil
+	}
+	ra.segs = segs
+	if off < ra.prefetchEnd && end > ra.nextOff {
+		// Part of the stream's prefetched data was removed.
+		ra.prefetchEnd = max(off, ra.nextOff)
+	}
+}
+
+// wait waits for prefetches in progress to finish.
+func (ra *readAhead) wait() {
+	if ra == nil {
+		return
+	}
+	ra.pending.Wait()
+}
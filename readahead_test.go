@@ -0,0 +1,141 @@
+package nbd
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitPrefetched waits for the cached segments on s to finish prefetching.
+// Prefetches are started as requests are received, so once a reply has
+// arrived, the prefetches started by its request are cached. It polls rather
+// than using readAhead.wait, since the receive loop may start new prefetches
+// concurrently.
+func waitPrefetched(t *testing.T, s *NbdServer) {
+	t.Helper()
+	s.backendLock.Lock()
+	ra := s.ra
+	s.backendLock.Unlock()
+	waitFor(t, "prefetches", func() bool {
+		ra.lock.Lock()
+		defer ra.lock.Unlock()
+		for _, seg := range ra.segs {
+			select {
+			case <-seg.ready:
+			default:
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestReadAhead(t *testing.T) {
+	const n = 16
+	dev := newMemDevice(1 << 20)
+	data := pattern(1<<20, 7)
+	copy(dev.data, data)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ReadAheadBytes: 65536})
+	c := startServer(t, s, k)
+
+	for i := 0; i < n; i++ {
+		off := uint64(i) * 4096
+		if got := c.read(uint64(i), off, 4096); string(got) != string(data[off:off+4096]) {
+			t.Fatalf("read %d returned the wrong data", i)
+		}
+		// Let prefetches finish, so that later reads hit.
+		waitPrefetched(t, s)
+	}
+	st := s.Stats()
+	if st.ReadAheadHits+st.ReadAheadMisses != n {
+		t.Errorf("got %d hits and %d misses, want %d reads", st.ReadAheadHits, st.ReadAheadMisses, n)
+	}
+	if st.ReadAheadMisses > readAheadMinSequential+1 {
+		t.Errorf("got %d misses for sequential reads", st.ReadAheadMisses)
+	}
+	var b strings.Builder
+	writeMetrics(&b, map[string]Stats{"dev": st})
+	if want := fmt.Sprintf("nbd_read_ahead_hits_total{device=\"dev\"} %d\n", st.ReadAheadHits); !strings.Contains(b.String(), want) {
+		t.Errorf("metrics don't contain %q", want)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestReadAheadInvalidation(t *testing.T) {
+	dev := newMemDevice(1 << 20)
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ReadAheadBytes: 65536})
+	c := startServer(t, s, k)
+
+	// Start prefetching after the third read.
+	for i := 0; i <= readAheadMinSequential; i++ {
+		c.read(uint64(i), uint64(i)*4096, 4096)
+	}
+	waitPrefetched(t, s)
+
+	// Writing and trimming prefetched data replaces it.
+	data := pattern(4096, 3)
+	c.write(10, 16384, data)
+	c.write(11, 20480, data)
+	c.send(nbdCmdTrim, 12, 20480, 4096, nil)
+	if code, _, _ := c.reply(0); code != 0 {
+		t.Fatalf("trim failed with %d", code)
+	}
+	if got := c.read(13, 12288, 4096); string(got) != string(make([]byte, 4096)) {
+		t.Error("read before the write returned the wrong data")
+	}
+	waitPrefetched(t, s)
+	if got := c.read(14, 16384, 4096); string(got) != string(data) {
+		t.Error("read returned stale prefetched data after a write")
+	}
+	waitPrefetched(t, s)
+	if got := c.read(15, 20480, 4096); string(got) != string(make([]byte, 4096)) {
+		t.Error("read returned stale prefetched data after a trim")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+// readCounter is a memDevice which counts reads.
+type readCounter struct {
+	*memDevice
+	reads atomic.Int32
+}
+
+func (d *readCounter) ReadAt(b []byte, off int64) (int, error) {
+	d.reads.Add(1)
+	return d.memDevice.ReadAt(b, off)
+}
+
+func TestReadAheadThrottled(t *testing.T) {
+	const n = 4
+	dev := &readCounter{memDevice: newMemDevice(1 << 20)}
+	// The burst allows less than one read, so every read is throttled, however
+	// far apart they are.
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ReadAheadBytes: 65536,
+		RateLimits:     RateLimits{ReadIOPS: 50, Burst: 10 * time.Millisecond},
+	})
+	c := startServer(t, s, k)
+
+	// Sequential reads which are throttled don't prefetch, since that would
+	// read from the device faster than the limit.
+	for i := 0; i < n; i++ {
+		c.read(uint64(i), uint64(i)*4096, 4096)
+		waitPrefetched(t, s)
+	}
+	st := s.Stats()
+	if st.Throttled != n {
+		t.Fatalf("%d reads were throttled, want %d", st.Throttled, n)
+	}
+	if r := dev.reads.Load(); r != n || st.ReadAheadHits != 0 {
+		t.Errorf("got %d device reads and %d read-ahead hits, want %d and 0", r, st.ReadAheadHits, n)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
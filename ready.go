@@ -0,0 +1,106 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// How often sysfs is checked while waiting for the device to be ready.
+	readyPollInterval = 10 * time.Millisecond
+)
+
+// fdSysfsDir returns the sysfs directory of the block device open as devFd.
+func fdSysfsDir(devFd int) (string, error) {
+	var st unix.Stat_t
+	err := unix.Fstat(devFd, &st)
+	if err != nil {
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", errors.New("nbd: not a block device")
+	}
+	return fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+}
+
+// WaitReady waits until the kernel device can be used, such as by mkfs or
+// mount. The device is ready once sysfs shows it has the size of the block
+// device, and that it was started by this process. Use a ctx with a timeout
+// to limit the wait. Returns an error if the server stops first.
+func (s *NbdServer) WaitReady(ctx context.Context) error {
+	if s.sysfs == "" {
+		return errors.New("nbd: sysfs directory of device unknown")
+	}
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for !s.ready() {
+		select {
+		case <-ticker.C:
+		case <-s.doneCh:
+			return errors.New("nbd: server stopped before device was ready")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ready returns true if sysfs shows the device is connected to this server.
+func (s *NbdServer) ready() bool {
+	sectors, err := s.readSysfsInt("size")
+	// The size attribute is always in units of 512 byte sectors.
+	if err != nil || sectors*512 != s.size {
+		return false
+	}
+	pid, err := s.readSysfsInt("pid")
+	if err != nil {
+		return false
+	}
+	return s.ownsPid(int(pid))
+}
+
+func (s *NbdServer) readSysfsInt(attr string) (int64, error) {
+	b, err := s.kc.readFile(s.sysfs + "/" + attr)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// ownsPid returns true if pid is this process, or one of its threads. The
+// kernel shows the ID of the thread which started the device.
+func (s *NbdServer) ownsPid(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	_, err := s.kc.readFile(fmt.Sprintf("/proc/self/task/%d/stat", pid))
+	return err == nil
+}
+
+// waitStarted sends EventConnected, and then drops privileges, once NBD_DO_IT
+// has started the device, which shows in sysfs. ctx is cancelled when
+// NBD_DO_IT returns. If the sysfs directory is unknown, EventConnected is sent
+// when the first request is received instead.
+func (s *NbdServer) waitStarted(ctx context.Context) error {
+	if s.sysfs == "" {
+		return nil
+	}
+	err := s.WaitReady(ctx)
+	if err != nil {
+		// The server stopped first, or the device failed to start.
+		return nil
+	}
+	s.connected()
+	err = s.dropPrivileges()
+	if err != nil {
+		s.Disconnect()
+	}
+	return err
+}
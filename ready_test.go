@@ -0,0 +1,69 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+
+	notReady := func(what string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*readyPollInterval)
+		defer cancel()
+		if err := s.WaitReady(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("WaitReady returned %v with %s, want a timeout", err, what)
+		}
+	}
+	// The device must have the right size, and have been started by this
+	// process, which the kernel shows as the ID of one of its threads.
+	k.setFile("/sys/block/nbd0/size", "1024\n")
+	notReady("the wrong size")
+	k.setFile("/sys/block/nbd0/size", fmt.Sprintf("%d\n", (1<<20)/512))
+	k.setFile("/sys/block/nbd0/pid", "123456789\n")
+	notReady("another process's pid")
+	k.setFile("/proc/self/task/123456789/stat", "")
+	if err := s.WaitReady(ctx); err != nil {
+		t.Errorf("WaitReady with a thread's pid: %v", err)
+	}
+
+	// WaitReady waits until the device is ready.
+	k.setFile("/sys/block/nbd0/pid", "1\n")
+	ready := make(chan error, 1)
+	go func() { ready <- s.WaitReady(ctx) }()
+	time.Sleep(2 * readyPollInterval)
+	k.setFile("/sys/block/nbd0/pid", fmt.Sprintf("%d\n", os.Getpid()))
+	if err := <-ready; err != nil {
+		t.Errorf("WaitReady: %v", err)
+	}
+
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	k.setFile("/sys/block/nbd0/pid", "1\n")
+	if err := s.WaitReady(ctx); err == nil {
+		t.Error("WaitReady succeeded after the server stopped")
+	}
+}
+
+func TestWaitReadyWithoutSysfs(t *testing.T) {
+	s, err := newServerFromFd(newFakeKernel(0), -1, newMemDevice(4096), 4096, BlockDeviceOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitReady(context.Background()); err == nil {
+		t.Error("WaitReady succeeded without the sysfs directory")
+	}
+}
@@ -10,16 +10,35 @@ const (
 	replyHeaderSize = 16
 )
 
+var (
+	replyPool = sync.Pool{New: func() any { return new(Reply) }}
+
+	defaultReplyBuffers = newBufferPool(replyHeaderSize)
+)
+
 type Reply struct {
 	handle uint64
 	err    uint32
-	buf    []byte
+	buf    *[]byte
+
+	// Number of bytes reserved against the memory limit for this reply.
+	reserved int64
+
+	// If pipe is set, the reply data is spliced from it by sp, instead of
+	// being sent from buf.
+	sp      *splicer
+	pipe    *splicePipe
+	pipeLen int
+
+	// Set if there is an Observer.
+	info *RequestInfo
 }
 
 func NewReply(handle uint64, dataSize int) *Reply {
+	buf := make([]byte, replyHeaderSize+dataSize)
 	return &Reply{
 		handle: handle,
-		buf:    make([]byte, replyHeaderSize+dataSize),
+		buf:    &buf,
 	}
 }
 
@@ -28,52 +47,64 @@ func (r *Reply) SetError(err uint32) {
 }
 
 func (r *Reply) Buffer() []byte {
-	return r.buf[replyHeaderSize:]
+	return (*r.buf)[replyHeaderSize:]
 }
 
 func (r *Reply) BufferSize() int {
-	return len(r.buf) - replyHeaderSize
+	return len(*r.buf) - replyHeaderSize
+}
+
+// bytes returns the encoded reply, including the header.
+func (r *Reply) bytes() []byte {
+	b := *r.buf
+	binary.BigEndian.PutUint32(b, nbdReplyMagic)
+	binary.BigEndian.PutUint32(b[4:], r.err)
+	binary.BigEndian.PutUint64(b[8:], r.handle)
+	if r.err != 0 {
+		// The kernel doesn't read the data of a failed read.
+		return b[:replyHeaderSize]
+	}
+	return b
 }
 
 func (r *Reply) Send(w io.Writer) error {
-	binary.BigEndian.PutUint32(r.buf, nbdReplyMagic)
-	binary.BigEndian.PutUint32(r.buf[4:], r.err)
-	binary.BigEndian.PutUint64(r.buf[8:], r.handle)
-	_, err := w.Write(r.buf)
+	_, err := w.Write(r.bytes())
 	return err
 }
 
+// ReplyPool creates replies using pooled buffers. The zero value shares its
+// buffers with other zero value ReplyPools.
 type ReplyPool struct {
-	pools map[int]*sync.Pool
-	lock  sync.Mutex
+	bufs  *bufferPool
+	limit *memLimiter
 }
 
-func (p *ReplyPool) getPool(size int) *sync.Pool {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-
-	if p.pools == nil {
-		p.pools = make(map[int]*sync.Pool)
+func (p *ReplyPool) buffers() *bufferPool {
+	if p.bufs == nil {
+		return defaultReplyBuffers
 	}
-
-	pool := p.pools[size]
-	if pool == nil {
-		pool = &sync.Pool{New: func() any {
-			return NewReply(0, size)
-		}}
-		p.pools[size] = pool
-	}
-	return pool
+	return p.bufs
 }
 
 func (p *ReplyPool) Get(handle uint64, size int) *Reply {
-	r := p.getPool(size).Get().(*Reply)
+	r := replyPool.Get().(*Reply)
 	r.handle = handle
 	r.err = 0
+	r.buf = p.buffers().get(size)
 	return r
 }
 
 func (p *ReplyPool) Put(r *Reply) {
-	size := r.BufferSize()
-	p.getPool(size).Put(r)
+	p.buffers().put(r.buf)
+	r.buf = nil
+	p.limit.release(r.reserved)
+	r.reserved = 0
+	if r.pipe != nil {
+		r.pipe.close()
+		r.pipe = nil
+	}
+	r.sp = nil
+	r.info = nil
+
+	replyPool.Put(r)
 }
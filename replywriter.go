@@ -0,0 +1,106 @@
+package nbd
+
+import (
+	"io"
+	"net"
+)
+
+const (
+	// Maximum number of replies written in a single batch.
+	maxReplyBatch = MaxConcurrentOps
+)
+
+// replyWriter sends replies completed by all workers. Replies which complete
+// while a write is in progress are gathered and sent together in a single
+// vectored write.
+type replyWriter struct {
+	w    io.Writer
+	sent func(r *Reply)
+	pool *ReplyPool
+	ch   chan *Reply
+}
+
+// newReplyWriter returns a replyWriter which writes to w. sent is called with
+// each reply once it has been written.
+func newReplyWriter(w io.Writer, sent func(r *Reply), pool *ReplyPool) *replyWriter {
+	return &replyWriter{
+		w:    w,
+		sent: sent,
+		pool: pool,
+		ch:   make(chan *Reply, maxReplyBatch),
+	}
+}
+
+// run writes replies until the reply channel is closed, or a write fails.
+func (rw *replyWriter) run() error {
+	batch := make([]*Reply, 0, maxReplyBatch)
+	bufs := make(net.Buffers, 0, maxReplyBatch)
+	for r := range rw.ch {
+		batch = append(batch[:0], r)
+	gather:
+		for len(batch) < maxReplyBatch {
+			select {
+			case r, ok := <-rw.ch:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, r)
+			default:
+				break gather
+			}
+		}
+
+		err := rw.writeBatch(batch, bufs)
+		if err == nil {
+			for _, r := range batch {
+				rw.sent(r)
+			}
+		}
+		for _, r := range batch {
+			rw.pool.Put(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard returns replies which weren't sent after run failed to the pool,
+// until the reply channel is closed, so that their buffers and reservations
+// aren't leaked.
+func (rw *replyWriter) discard() {
+	for r := range rw.ch {
+		rw.pool.Put(r)
+	}
+}
+
+func (rw *replyWriter) writeBatch(batch []*Reply, bufs net.Buffers) error {
+	bufs = bufs[:0]
+	flush := func() error {
+		// WriteTo consumes the slice it is called on, so use a copy to allow
+		// bufs to be reused.
+		wb := bufs
+		_, err := wb.WriteTo(rw.w)
+		bufs = bufs[:0]
+		return err
+	}
+
+	for _, r := range batch {
+		bufs = append(bufs, r.bytes())
+		if r.pipe != nil {
+			// The header has to be written before the data can be spliced.
+			err := flush()
+			if err != nil {
+				return err
+			}
+			p := r.pipe
+			r.pipe = nil
+			err = r.sp.sendPipe(p, r.pipeLen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
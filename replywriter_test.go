@@ -0,0 +1,122 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplyWriteErrorReleasesBuffers(t *testing.T) {
+	s, k := newTestServer(t, newMemDevice(1<<20), 1<<20,
+		BlockDeviceOptions{ConcurrentOps: 8, MaxInFlightBytes: 64 << 10})
+	c := startServer(t, s, k)
+
+	// Make the server's writes fail, while its reads still block.
+	if err := c.conn.(*net.UnixConn).CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	// The server stops once a reply fails, after which requests can't be sent.
+	var req [requestHeaderSize]byte
+	binary.BigEndian.PutUint32(req[0:], nbdRequestMagic)
+	binary.BigEndian.PutUint16(req[6:], nbdCmdRead)
+	binary.BigEndian.PutUint32(req[24:], 4096)
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	for i := 0; i < 256; i++ {
+		binary.BigEndian.PutUint64(req[8:], uint64(i))
+		if _, err := c.conn.Write(req[:]); err != nil {
+			break
+		}
+	}
+	c.wait()
+	if st := s.BufferStats(); st.InFlightBytes != 0 {
+		t.Errorf("%d bytes still reserved after stopping", st.InFlightBytes)
+	}
+}
+
+// blockingWriter blocks the first Write until released, and records how many
+// replies had been sent at each Write.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	sent    *int
+	writes  []int
+	data    []byte
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	if len(w.writes) == 0 {
+		close(w.started)
+		<-w.release
+	}
+	w.writes = append(w.writes, *w.sent)
+	w.data = append(w.data, b...)
+	return len(b), nil
+}
+
+func TestReplyWriterBatches(t *testing.T) {
+	var sent int
+	w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{}), sent: &sent}
+	var pool ReplyPool
+	rw := newReplyWriter(w, func(*Reply) { sent++ }, &pool)
+	done := make(chan error, 1)
+	go func() { done <- rw.run() }()
+
+	rw.ch <- pool.Get(0, 0)
+	<-w.started
+	// Replies completed while the first is being written are sent together.
+	for i := 1; i < 6; i++ {
+		rw.ch <- pool.Get(uint64(i), 0)
+	}
+	close(rw.ch)
+	close(w.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{0, 1, 1, 1, 1, 1}
+	if len(w.writes) != len(want) {
+		t.Fatalf("got %d writes, want %d", len(w.writes), len(want))
+	}
+	for i := range want {
+		if w.writes[i] != want[i] {
+			t.Fatalf("replies sent before each write are %v, want %v", w.writes, want)
+		}
+	}
+	if sent != 6 {
+		t.Errorf("%d replies sent, want 6", sent)
+	}
+	for i := 0; i < 6; i++ {
+		hdr := w.data[i*replyHeaderSize:]
+		if h := binary.BigEndian.Uint64(hdr[8:]); h != uint64(i) {
+			t.Errorf("reply %d has handle %d", i, h)
+		}
+	}
+}
+
+func TestConcurrentReplies(t *testing.T) {
+	dev := newMemDevice(1 << 20)
+	for i := 0; i < 64; i++ {
+		copy(dev.data[i*4096:], pattern(4096, byte(i)))
+	}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: 16})
+	c := startServer(t, s, k)
+
+	for i := 0; i < 64; i++ {
+		c.send(nbdCmdRead, uint64(i), uint64(i)*4096, 4096, nil)
+	}
+	seen := make(map[uint64]bool)
+	for i := 0; i < 64; i++ {
+		code, h, data := c.reply(4096)
+		if code != 0 || seen[h] || h >= 64 {
+			t.Fatalf("unexpected reply: code %d, handle %d", code, h)
+		}
+		seen[h] = true
+		if string(data) != string(pattern(4096, byte(h))) {
+			t.Errorf("reply %d has the wrong data", h)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
@@ -2,10 +2,12 @@ package nbd
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 )
 
 const (
@@ -15,8 +17,43 @@ const (
 var (
 	nbo         = binary.BigEndian
 	requestPool = sync.Pool{New: func() any { return new(Request) }}
+
+	defaultRequestBuffers = newBufferPool(0)
+)
+
+// Command is the type of a request.
+type Command uint16
+
+const (
+	CmdRead        Command = nbdCmdRead
+	CmdWrite       Command = nbdCmdWrite
+	CmdDisconnect  Command = nbdCmdDisc
+	CmdFlush       Command = nbdCmdFlush
+	CmdTrim        Command = nbdCmdTrim
+	CmdCache       Command = nbdCmdCache
+	CmdWriteZeroes Command = nbdCmdWriteZeroes
 )
 
+func (c Command) String() string {
+	switch c {
+	case CmdRead:
+		return "Read"
+	case CmdWrite:
+		return "Write"
+	case CmdDisconnect:
+		return "Disconnect"
+	case CmdFlush:
+		return "Flush"
+	case CmdTrim:
+		return "Trim"
+	case CmdCache:
+		return "Cache"
+	case CmdWriteZeroes:
+		return "WriteZeros"
+	}
+	return "<Unsupported>"
+}
+
 type Request struct {
 	flags  uint16
 	cmd    uint16
@@ -24,6 +61,39 @@ type Request struct {
 	offset uint64
 	length uint32
 	buf    *[]byte
+
+	// Number of bytes reserved against the memory limit for this request.
+	reserved int64
+
+	// Pipe holding the data of a spliced write request.
+	pipe *splicePipe
+
+	// Entry used to order the request with overlapping requests.
+	rl *rangeEntry
+
+	// Time the request was received.
+	received time.Time
+
+	// Set if there is an Observer.
+	info *RequestInfo
+
+	// Entry in the server's in-flight requests.
+	flight *InFlightRequest
+
+	// If set, the request isn't performed until this time, to keep within the
+	// rate limits.
+	throttled time.Time
+}
+
+// op returns the operation for the request, without its data.
+func (r *Request) op() Op {
+	return Op{
+		Command: Command(r.cmd),
+		Flags:   r.flags,
+		Handle:  r.handle,
+		Offset:  int64(r.offset),
+		Length:  r.length,
+	}
 }
 
 func (r *Request) Buffer() []byte {
@@ -33,27 +103,18 @@ func (r *Request) Buffer() []byte {
 	return *r.buf
 }
 
+// canCoalesce returns true if r can be merged with adjacent writes.
+func (r *Request) canCoalesce() bool {
+	return r.cmd == nbdCmdWrite && r.pipe == nil && r.buf != nil
+}
+
 func (r *Request) String() string {
-	name := "<Unsupported>"
 	args := ""
 	switch r.cmd {
-	case nbdCmdRead:
-		name = "Read"
-		args = fmt.Sprintf("offset: %d, length: %d", r.offset, r.length)
-	case nbdCmdWrite:
-		name = "Write"
+	case nbdCmdRead, nbdCmdWrite, nbdCmdTrim:
 		args = fmt.Sprintf("offset: %d, length: %d", r.offset, r.length)
-	case nbdCmdFlush:
-		name = "Flush"
-	case nbdCmdTrim:
-		name = "Trim"
-		args = fmt.Sprintf("offset: %d, length: %d", r.offset, r.length)
-	case nbdCmdCache:
-		name = "Cache"
-	case nbdCmdWriteZeroes:
-		name = "WriteZeros"
 	}
-	return fmt.Sprintf("%s(%s)", name, args)
+	return fmt.Sprintf("%v(%s)", Command(r.cmd), args)
 }
 
 func (r *Request) readHeader(b *bufio.Reader) error {
@@ -75,51 +136,82 @@ func (r *Request) readHeader(b *bufio.Reader) error {
 	return err
 }
 
+// RequestPool receives requests, using pooled buffers for write data.
+// The zero value shares its buffers with other zero value RequestPools, and
+// doesn't limit memory use.
 type RequestPool struct {
-	pools map[int]*sync.Pool
-	lock  sync.Mutex
+	bufs  *bufferPool
+	limit *memLimiter
 }
 
-func (p *RequestPool) getPool(size int) *sync.Pool {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-
-	if p.pools == nil {
-		p.pools = make(map[int]*sync.Pool)
+func (p *RequestPool) buffers() *bufferPool {
+	if p.bufs == nil {
+		return defaultRequestBuffers
 	}
+	return p.bufs
+}
 
-	pool := p.pools[size]
-	if pool == nil {
-		pool = &sync.Pool{New: func() any {
-			b := make([]byte, size)
-			return &b
-		}}
-		p.pools[size] = pool
+func (p *RequestPool) Recv(b *bufio.Reader) (*Request, error) {
+	r, err := p.recvHeader(context.Background(), b)
+	if err != nil {
+		return nil, err
+	}
+	if r.cmd == nbdCmdWrite {
+		err = p.recvData(r, b)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return pool
+	return r, nil
 }
 
-func (p *RequestPool) Recv(b *bufio.Reader) (*Request, error) {
+// recvHeader reads the header of a request. If the memory limit has been
+// reached, it waits for space for the request's data until ctx is done.
+func (p *RequestPool) recvHeader(ctx context.Context, b *bufio.Reader) (*Request, error) {
 	r := requestPool.Get().(*Request)
 	err := r.readHeader(b)
 	if err != nil {
 		return nil, err
 	}
-	if r.cmd == nbdCmdWrite {
-		r.buf = p.getPool(int(r.length)).Get().(*[]byte)
-		_, err = io.ReadFull(b, *r.buf)
+	if r.cmd == nbdCmdRead || r.cmd == nbdCmdWrite {
+		// Reserve space for the data of both read and write requests before
+		// accepting them, which applies backpressure to the kernel.
+		err = p.limit.reserve(ctx, int64(r.length))
 		if err != nil {
+			p.Put(r)
 			return nil, err
 		}
+		r.reserved = int64(r.length)
 	}
 	return r, nil
 }
 
+// recvData reads the data of write request r into a buffer. On error, r is
+// returned to the pool.
+func (p *RequestPool) recvData(r *Request, b *bufio.Reader) error {
+	r.buf = p.buffers().get(int(r.length))
+	_, err := io.ReadFull(b, *r.buf)
+	if err != nil {
+		p.Put(r)
+	}
+	return err
+}
+
 func (p *RequestPool) Put(r *Request) {
 	if r.buf != nil {
-		p.getPool(int(r.length)).Put(r.buf)
+		p.buffers().put(r.buf)
 		r.buf = nil
 	}
+	if r.pipe != nil {
+		r.pipe.close()
+		r.pipe = nil
+	}
+	r.rl = nil
+	r.info = nil
+	r.flight = nil
+	r.throttled = time.Time{}
+	p.limit.release(r.reserved)
+	r.reserved = 0
 
 	requestPool.Put(r)
 }
@@ -0,0 +1,205 @@
+package nbd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	spanScopeName = "github.com/akmistry/go-nbd"
+
+	// OpenTelemetry span status codes.
+	spanStatusOk    = 1
+	spanStatusError = 2
+
+	// OpenTelemetry span kinds.
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Span is a completed span, following the OpenTelemetry trace data model.
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]any
+	// Err is set if the operation covered by the span failed.
+	Err error
+}
+
+// SpanExporter receives the spans of each request.
+type SpanExporter interface {
+	ExportSpans(spans []Span) error
+}
+
+// SpanObserver is an Observer which creates a trace for each request. The
+// root span covers the request from being received to its reply being sent,
+// with child spans for time spent queued, in the block device, and sending
+// the reply.
+type SpanObserver struct {
+	exp SpanExporter
+}
+
+// NewSpanObserver returns a SpanObserver which exports spans to exp.
+func NewSpanObserver(exp SpanExporter) *SpanObserver {
+	return &SpanObserver{exp: exp}
+}
+
+func (o *SpanObserver) RequestReceived(info *RequestInfo)   {}
+func (o *SpanObserver) RequestDispatched(info *RequestInfo) {}
+func (o *SpanObserver) RequestCompleted(info *RequestInfo)  {}
+
+func (o *SpanObserver) ReplySent(info *RequestInfo) {
+	var traceID [16]byte
+	randomId(traceID[:])
+	attrs := map[string]any{
+		"nbd.command": info.Command.String(),
+		"nbd.handle":  info.Handle,
+		"nbd.offset":  info.Offset,
+		"nbd.length":  info.Length,
+	}
+	span := func(name string, parent *Span, start, end time.Time) Span {
+		s := Span{
+			TraceID: traceID,
+			Name:    name,
+			Start:   start,
+			End:     end,
+		}
+		randomId(s.SpanID[:])
+		if parent != nil {
+			s.ParentSpanID = parent.SpanID
+		}
+		return s
+	}
+
+	root := span("nbd."+info.Command.String(), nil, info.Received, info.Sent)
+	root.Attributes = attrs
+	root.Err = info.Err
+	backend := span("backend", &root, info.Dispatched, info.Completed)
+	backend.Err = info.Err
+	o.exp.ExportSpans([]Span{
+		root,
+		span("queue", &root, info.Received, info.Dispatched),
+		backend,
+		span("reply", &root, info.Completed, info.Sent),
+	})
+}
+
+var (
+	idRandLock sync.Mutex
+	idRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randomId(b []byte) {
+	idRandLock.Lock()
+	idRand.Read(b)
+	idRandLock.Unlock()
+}
+
+// JSONSpanExporter writes spans as OTLP/JSON, one ExportTraceServiceRequest
+// per line, which can be read by the OpenTelemetry collector's
+// otlpjsonfile receiver.
+type JSONSpanExporter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONSpanExporter returns a JSONSpanExporter which writes to w.
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{enc: json.NewEncoder(w)}
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case uint16:
+		return map[string]any{"intValue": strconv.FormatUint(uint64(v), 10)}
+	case uint32:
+		return map[string]any{"intValue": strconv.FormatUint(uint64(v), 10)}
+	case uint64:
+		return map[string]any{"intValue": strconv.FormatUint(v, 10)}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return map[string]any{"boolValue": v}
+	}
+	return map[string]any{"stringValue": ""}
+}
+
+func (e *JSONSpanExporter) ExportSpans(spans []Span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              spanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: spanStatusOk},
+		}
+		if s.ParentSpanID != ([8]byte{}) {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+			span.Kind = spanKindInternal
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: k, Value: otlpValue(s.Attributes[k])})
+		}
+		if s.Err != nil {
+			span.Status = otlpStatus{Code: spanStatusError, Message: s.Err.Error()}
+		}
+		out = append(out, span)
+	}
+
+	req := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": spanScopeName},
+				"spans": out,
+			}},
+		}},
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.enc.Encode(req)
+}
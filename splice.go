@@ -0,0 +1,258 @@
+package nbd
+
+import (
+	"bufio"
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Requested size of the pipes used to splice write data. Writes larger than
+	// the pipe are copied through user space instead.
+	splicePipeSize = 1024 * 1024
+
+	// Request headers are read with a buffer no larger than a header when
+	// splicing, so that write data is left in the socket.
+	spliceReadBufferSize = requestHeaderSize
+)
+
+// BlockDeviceFd can be implemented by a BlockDevice backed by a file
+// descriptor, such as a regular file. Read and write data is then moved
+// directly between the file and the kernel socket using splice, without being
+// copied through user space. ReadAt and WriteAt must be equivalent to pread
+// and pwrite on the file descriptor.
+//
+// Spliced read data shares the file's pages until the kernel has received it,
+// so a later write could change it. If OrderOverlapping is set, reads are
+// therefore copied through user space.
+type BlockDeviceFd interface {
+	BackingFd() uintptr
+}
+
+type splicePipe struct {
+	r, w int
+	size int
+}
+
+func newSplicePipe() (*splicePipe, error) {
+	var fds [2]int
+	err := unix.Pipe2(fds[:], unix.O_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &splicePipe{r: fds[0], w: fds[1]}
+	p.size, err = unix.FcntlInt(uintptr(p.w), unix.F_SETPIPE_SZ, splicePipeSize)
+	if err != nil {
+		// The system limit might be lower than the requested size, in which case
+		// use the default.
+		p.size, err = unix.FcntlInt(uintptr(p.w), unix.F_GETPIPE_SZ, 0)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *splicePipe) close() {
+	unix.Close(p.r)
+	unix.Close(p.w)
+}
+
+// splicer moves request data between the kernel socket and a file descriptor
+// using splice.
+type splicer struct {
+	fd    int
+	sock  syscall.RawConn
+	pipes chan *splicePipe
+}
+
+func newSplicer(fd int, sock syscall.RawConn, maxPipes int) *splicer {
+	return &splicer{
+		fd:    fd,
+		sock:  sock,
+		pipes: make(chan *splicePipe, maxPipes),
+	}
+}
+
+func (sp *splicer) getPipe() (*splicePipe, error) {
+	select {
+	case p := <-sp.pipes:
+		return p, nil
+	default:
+	}
+	return newSplicePipe()
+}
+
+func (sp *splicer) putPipe(p *splicePipe) {
+	select {
+	case sp.pipes <- p:
+	default:
+		p.close()
+	}
+}
+
+func (sp *splicer) close() {
+	for {
+		select {
+		case p := <-sp.pipes:
+			p.close()
+		default:
+			return
+		}
+	}
+}
+
+// recvData moves the data for write request r from the socket into a pipe.
+// Returns false if the data is too large to be spliced, in which case nothing
+// has been read.
+func (sp *splicer) recvData(r *Request, b *bufio.Reader) (bool, error) {
+	p, err := sp.getPipe()
+	if err != nil {
+		return false, err
+	}
+	if int(r.length) > p.size {
+		sp.putPipe(p)
+		return false, nil
+	}
+
+	remaining := int(r.length)
+	if n := b.Buffered(); n > 0 {
+		// Part of the data has already been read from the socket.
+		if n > remaining {
+			n = remaining
+		}
+		buffered, _ := b.Peek(n)
+		_, err = unix.Write(p.w, buffered)
+		if err != nil {
+			p.close()
+			return false, err
+		}
+		b.Discard(n)
+		remaining -= n
+	}
+
+	var spliceErr error
+	err = sp.sock.Read(func(fd uintptr) bool {
+		for remaining > 0 {
+			n, err := unix.Splice(int(fd), nil, p.w, nil, remaining, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			if err == unix.EAGAIN {
+				return false
+			} else if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				spliceErr = err
+				return true
+			} else if n == 0 {
+				spliceErr = io.ErrUnexpectedEOF
+				return true
+			}
+			remaining -= int(n)
+		}
+		return true
+	})
+	if err == nil {
+		err = spliceErr
+	}
+	if err != nil {
+		p.close()
+		return false, err
+	}
+	r.pipe = p
+	return true, nil
+}
+
+// writeAt moves the data of write request r from its pipe into the file.
+func (sp *splicer) writeAt(r *Request) error {
+	p := r.pipe
+	r.pipe = nil
+
+	off := int64(r.offset)
+	remaining := int(r.length)
+	for remaining > 0 {
+		n, err := unix.Splice(p.r, nil, sp.fd, &off, remaining, unix.SPLICE_F_MOVE)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			// The pipe may still contain data, so it can't be reused.
+			p.close()
+			return err
+		} else if n == 0 {
+			p.close()
+			return io.ErrShortWrite
+		}
+		remaining -= int(n)
+	}
+	sp.putPipe(p)
+	return nil
+}
+
+// readAt moves length bytes of the file at off into a pipe, from which they
+// are sent as the data of a read reply. Like ReadAt, it returns
+// io.ErrUnexpectedEOF if the file is shorter than off+length. Returns a nil
+// pipe if the data is too large to be spliced, in which case nothing has been
+// read.
+func (sp *splicer) readAt(off int64, length int) (*splicePipe, error) {
+	p, err := sp.getPipe()
+	if err != nil {
+		return nil, err
+	}
+	if length > p.size {
+		sp.putPipe(p)
+		return nil, nil
+	}
+
+	remaining := length
+	for remaining > 0 {
+		n, err := unix.Splice(sp.fd, &off, p.w, nil, remaining, unix.SPLICE_F_MOVE)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			p.close()
+			return nil, err
+		} else if n == 0 {
+			// The pipe contains part of the data, so it can't be reused.
+			p.close()
+			return nil, io.ErrUnexpectedEOF
+		}
+		remaining -= int(n)
+	}
+	return p, nil
+}
+
+// sendPipe sends the length bytes of data in p to the socket. p is reused
+// once it has been emptied.
+func (sp *splicer) sendPipe(p *splicePipe, length int) error {
+	remaining := length
+	var sendErr error
+	err := sp.sock.Write(func(fd uintptr) bool {
+		for remaining > 0 {
+			n, err := unix.Splice(p.r, nil, int(fd), nil, remaining, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			if err == unix.EAGAIN {
+				return false
+			} else if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				sendErr = err
+				return true
+			} else if n == 0 {
+				sendErr = io.ErrUnexpectedEOF
+				return true
+			}
+			remaining -= int(n)
+		}
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		// The pipe may still contain data, so it can't be reused.
+		p.close()
+		return err
+	}
+	sp.putPipe(p)
+	return nil
+}
@@ -0,0 +1,135 @@
+package nbd
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// fileDevice is a BlockDeviceFd backed by a temporary file, which counts the
+// reads and writes which aren't spliced.
+type fileDevice struct {
+	*os.File
+	reads, writes atomic.Int32
+}
+
+func newFileDevice(t *testing.T, size int64) *fileDevice {
+	f, err := os.CreateTemp(t.TempDir(), "nbd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return &fileDevice{File: f}
+}
+
+func (d *fileDevice) ReadAt(b []byte, off int64) (int, error) {
+	d.reads.Add(1)
+	return d.File.ReadAt(b, off)
+}
+
+func (d *fileDevice) WriteAt(b []byte, off int64) (int, error) {
+	d.writes.Add(1)
+	return d.File.WriteAt(b, off)
+}
+
+func (d *fileDevice) BackingFd() uintptr {
+	return d.File.Fd()
+}
+
+func TestSplice(t *testing.T) {
+	const size = 4 << 20
+	dev := newFileDevice(t, size)
+	s, k := newTestServer(t, dev, size, BlockDeviceOptions{ConcurrentOps: 4})
+	c := startServer(t, s, k)
+
+	small := pattern(64<<10, 1)
+	c.write(1, 4096, small)
+	if got := c.read(2, 4096, uint32(len(small))); string(got) != string(small) {
+		t.Error("read didn't return written data")
+	}
+	inFile := make([]byte, len(small))
+	dev.File.ReadAt(inFile, 4096)
+	if string(inFile) != string(small) {
+		t.Error("written data isn't in the file")
+	}
+	if r, w := dev.reads.Load(), dev.writes.Load(); r != 0 || w != 0 {
+		t.Errorf("got %d reads and %d writes through user space, want none", r, w)
+	}
+
+	// Writes larger than the pipe are copied through user space.
+	large := pattern(2<<20, 2)
+	c.write(3, 1<<20, large)
+	if got := c.read(4, 1<<20, uint32(len(large))); string(got) != string(large) {
+		t.Error("read didn't return large written data")
+	}
+	if r, w := dev.reads.Load(), dev.writes.Load(); r != 1 || w != 1 {
+		t.Errorf("got %d reads and %d writes through user space, want 1 each", r, w)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+// writeOnlyFdDevice is a fileDevice whose backing file descriptor can't be
+// read from.
+type writeOnlyFdDevice struct {
+	*fileDevice
+	wo *os.File
+}
+
+func (d *writeOnlyFdDevice) BackingFd() uintptr {
+	return d.wo.Fd()
+}
+
+func TestSpliceReadError(t *testing.T) {
+	dev := newFileDevice(t, 1<<20)
+	wo, err := os.OpenFile(dev.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wo.Close()
+	s, k := newTestServer(t, &writeOnlyFdDevice{fileDevice: dev, wo: wo}, 1<<20, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+
+	// A failed read is replied to with an error, instead of terminating the
+	// connection.
+	c.send(nbdCmdRead, 1, 0, 4096, nil)
+	if code, h, _ := c.reply(0); code != nbdEio || h != 1 {
+		t.Errorf("got error %d for handle %d, want %d for handle 1", code, h, nbdEio)
+	}
+	data := pattern(4096, 1)
+	c.write(2, 0, data)
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if st := s.Stats(); st.Errors[nbdEio] != 1 || st.Failures != 1 {
+		t.Errorf("got %d EIO replies and %d failures, want 1 each", st.Errors[nbdEio], st.Failures)
+	}
+}
+
+func TestSpliceReadPastEOF(t *testing.T) {
+	const size = 4 << 20
+	dev := newFileDevice(t, size)
+	s, k := newTestServer(t, dev, size, BlockDeviceOptions{})
+	c := startServer(t, s, k)
+	if err := dev.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads past the end of the file fail whether or not they are spliced.
+	for i, length := range []uint32{4096, 2 << 20} {
+		c.send(nbdCmdRead, uint64(i), 2<<20, length, nil)
+		if code, _, _ := c.reply(0); code != nbdEio {
+			t.Errorf("read of %d bytes past the end of the file got error %d, want %d", length, code, nbdEio)
+		}
+	}
+	if r := dev.reads.Load(); r != 1 {
+		t.Errorf("got %d reads through user space, want 1", r)
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package nbd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSwapBackend(t *testing.T) {
+	old := newGatedDevice(1 << 20)
+	swapped := make(chan struct{}, 1)
+	s, k := newTestServer(t, old, 1<<20, BlockDeviceOptions{
+		ConcurrentOps: 4,
+		OnEvent: func(ev Event) {
+			if ev.Type == EventBackendSwapped {
+				swapped <- struct{}{}
+			}
+		},
+	})
+	c := startServer(t, s, k)
+
+	first := pattern(4096, 1)
+	c.send(nbdCmdWrite, 1, 0, 4096, first)
+	old.expectStart(t, 0)
+
+	// The swap waits for the in-flight write, and holds new requests.
+	dev := newMemDevice(1 << 20)
+	swapErr := make(chan error, 1)
+	go func() { swapErr <- s.SwapBackend(dev) }()
+	waitFor(t, "requests to be paused", func() bool {
+		s.quiesce.lock.Lock()
+		defer s.quiesce.lock.Unlock()
+		return s.quiesce.pauses > 0
+	})
+	second := pattern(4096, 2)
+	c.send(nbdCmdWrite, 2, 4096, 4096, second)
+	old.expectNoStart(t)
+	select {
+	case err := <-swapErr:
+		t.Fatalf("SwapBackend returned %v with a request in flight", err)
+	default:
+	}
+
+	// The old device is flushed once the write completes.
+	old.release(t, 0)
+	if code, h, _ := c.reply(0); code != 0 || h != 1 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 1", code, h)
+	}
+	old.expectStart(t, -1)
+	old.release(t, -1)
+	select {
+	case err := <-swapErr:
+		if err != nil {
+			t.Fatalf("SwapBackend: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("SwapBackend didn't return")
+	}
+
+	if code, h, _ := c.reply(0); code != 0 || h != 2 {
+		t.Fatalf("got reply with code %d for handle %d, want 0, 2", code, h)
+	}
+	if got := c.read(3, 4096, 4096); string(got) != string(second) {
+		t.Error("requests after the swap weren't performed on the new device")
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if string(old.data[4096:8192]) != string(make([]byte, 4096)) {
+		t.Error("request held by the swap was performed on the old device")
+	}
+	if old.flushes != 1 {
+		t.Errorf("old device was flushed %d times, want 1", old.flushes)
+	}
+	select {
+	case <-swapped:
+	default:
+		t.Error("no backend swapped event")
+	}
+}
@@ -0,0 +1,37 @@
+package nbd
+
+// Transport identifies the mechanism used to configure the kernel nbd driver.
+type Transport int
+
+const (
+	// TransportIoctl uses ioctls on the /dev/nbdX device.
+	TransportIoctl Transport = iota
+	// TransportNetlink uses the "nbd" generic netlink family.
+	TransportNetlink
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportIoctl:
+		return "ioctl"
+	case TransportNetlink:
+		return "netlink"
+	}
+	return "<unknown>"
+}
+
+// TransportInfo describes the transport used by a NbdServer, and the kernel
+// features it uses. Netlink is only used with a single socket, and without
+// reconfiguring the device, so it adds no features beyond DisconnectOnClose
+// and BackendIdentifier.
+type TransportInfo struct {
+	Transport Transport
+
+	// NetlinkVersion is the version of the "nbd" generic netlink family.
+	// Zero when using ioctls.
+	NetlinkVersion uint8
+
+	// BackendIdentifier is true if the kernel supports the BackendIdentifier
+	// option, according to the attribute policy of the netlink family.
+	BackendIdentifier bool
+}
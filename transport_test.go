@@ -0,0 +1,76 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/genetlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestTransport(t *testing.T) {
+	opts := BlockDeviceOptions{Logger: testLogger()}
+	s, err := newServerAuto(newFakeKernel(nbdNlVersion), 0, newMemDevice(4096), 4096, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TransportInfo{Transport: TransportNetlink, NetlinkVersion: nbdNlVersion, BackendIdentifier: true}
+	if got := s.Transport(); got != want {
+		t.Errorf("netlink transport is %+v, want %+v", got, want)
+	}
+
+	// Kernels before 5.19 don't have the backend identifier in their policy,
+	// and before 5.8 can't dump their policy at all.
+	noBackendId := newFakeKernel(nbdNlVersion)
+	noBackendId.policyAttrs = noBackendId.policyAttrs[:len(noBackendId.policyAttrs)-1]
+	noPolicy := newFakeKernel(nbdNlVersion)
+	noPolicy.policyAttrs = nil
+	for _, k := range []*fakeKernel{noBackendId, noPolicy} {
+		s, err = newServerAuto(k, 0, newMemDevice(4096), 4096, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = TransportInfo{Transport: TransportNetlink, NetlinkVersion: nbdNlVersion}
+		if got := s.Transport(); got != want {
+			t.Errorf("netlink transport with policy %v is %+v, want %+v", k.policyAttrs, got, want)
+		}
+	}
+
+	s, err = newServerFromFd(newFakeKernel(0), -1, newMemDevice(4096), 4096, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = TransportInfo{Transport: TransportIoctl}
+	if got := s.Transport(); got != want {
+		t.Errorf("ioctl transport is %+v, want %+v", got, want)
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	opts := BlockDeviceOptions{Logger: testLogger()}
+
+	// The "nbd" netlink family doesn't exist.
+	k := newFakeKernel(0)
+	s, err := newServerAuto(k, 3, newMemDevice(4096), 4096, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(s.devFd)
+	if got := s.Transport(); got.Transport != TransportIoctl {
+		t.Errorf("got transport %v, want ioctl", got.Transport)
+	}
+	if want := []string{"/dev/nbd3"}; fmt.Sprint(k.opened) != fmt.Sprint(want) {
+		t.Errorf("opened %q, want %q", k.opened, want)
+	}
+
+	// The family is too old, and the device can't be opened either.
+	k = newFakeKernel(0)
+	k.family = genetlink.Family{ID: 0x20, Version: nbdNlVersion - 1, Name: nbdNlFamilyName}
+	k.openErr = unix.ENOENT
+	_, err = newServerAuto(k, 3, newMemDevice(4096), 4096, opts)
+	if !errors.Is(err, unix.ENOENT) || !strings.Contains(err.Error(), "unsupported netlink version") {
+		t.Errorf("got error %v, want both the netlink and open errors", err)
+	}
+}
@@ -0,0 +1,339 @@
+package nbd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultWorkerIdleTimeout = time.Second
+
+	// When adapting the number of workers, a worker is added while requests
+	// are queued if the average backend latency is at least this long, since
+	// faster backends gain little from the extra concurrency. Workers are
+	// always added once the queue is longer than the number of workers.
+	adaptiveGrowLatency = 50 * time.Microsecond
+
+	// Weight of each new sample in the average backend latency, as a shift.
+	latencyEwmaShift = 3
+)
+
+// workerPool runs the workers which perform requests on the block device.
+// If min < max, the number of workers adapts to the load.
+type workerPool struct {
+	s       *NbdServer
+	g       *errgroup.Group
+	ctx     context.Context
+	reqCh   chan *Request
+	replyCh chan<- *Reply
+	senders *sync.WaitGroup
+
+	min, max    int
+	idleTimeout time.Duration
+
+	lock   sync.Mutex
+	count  int
+	nextId int
+
+	idle    atomic.Int32
+	latency atomic.Int64
+}
+
+func newWorkerPool(s *NbdServer, ctx context.Context, g *errgroup.Group, replyCh chan<- *Reply, senders *sync.WaitGroup) *workerPool {
+	p := &workerPool{
+		s:           s,
+		g:           g,
+		ctx:         ctx,
+		reqCh:       make(chan *Request, s.opts.ConcurrentOps),
+		replyCh:     replyCh,
+		senders:     senders,
+		min:         s.opts.ConcurrentOps,
+		max:         s.opts.ConcurrentOps,
+		idleTimeout: s.opts.WorkerIdleTimeout,
+	}
+	if s.opts.MinConcurrentOps > 0 {
+		p.min = s.opts.MinConcurrentOps
+	}
+	if p.idleTimeout == 0 {
+		p.idleTimeout = DefaultWorkerIdleTimeout
+	}
+	return p
+}
+
+func (p *workerPool) start() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for p.count < p.min {
+		// The first worker is started regardless of the budget, so that every
+		// device makes progress.
+		if !p.s.workerBudget.acquire(p.count == 0) {
+			break
+		}
+		p.spawnLocked()
+	}
+}
+
+func (p *workerPool) spawnLocked() {
+	id := p.nextId
+	p.nextId++
+	p.count++
+	p.s.numWorkers.Add(1)
+	p.senders.Add(1)
+	p.g.Go(func() error {
+		return p.run(id)
+	})
+}
+
+// stop causes the workers to exit once all queued requests have been done.
+func (p *workerPool) stop() {
+	close(p.reqCh)
+}
+
+// discard returns requests which weren't performed after the workers
+// stopped early to the pool. It must be called after stop, once the workers
+// have exited.
+func (p *workerPool) discard() {
+	for req := range p.reqCh {
+		p.s.reqPool.Put(req)
+	}
+}
+
+// dispatch queues req to be performed by a worker.
+func (p *workerPool) dispatch(req *Request) error {
+	select {
+	case p.reqCh <- req:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+	p.maybeGrow()
+	return nil
+}
+
+func (p *workerPool) maybeGrow() {
+	if (p.min == p.max && p.s.workerBudget == nil) || p.idle.Load() > 0 {
+		return
+	}
+	queued := len(p.reqCh)
+	if queued == 0 {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.count >= p.max {
+		return
+	}
+	// Below min, the budget was used up when the workers were started.
+	if p.count >= p.min && time.Duration(p.latency.Load()) < adaptiveGrowLatency && queued <= p.count {
+		return
+	}
+	if !p.s.workerBudget.acquire(false) {
+		return
+	}
+	p.spawnLocked()
+}
+
+// retire returns true if an idle worker should exit.
+func (p *workerPool) retire() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.count <= p.min {
+		return false
+	}
+	p.count--
+	p.s.numWorkers.Add(-1)
+	p.s.workerBudget.release()
+	return true
+}
+
+func (p *workerPool) recordLatency(d time.Duration) {
+	// Races between concurrent updates only lose samples, which is fine for an
+	// estimate.
+	avg := p.latency.Load()
+	p.latency.Store(avg + (int64(d)-avg)>>latencyEwmaShift)
+}
+
+// run is the loop of the worker with the given ID.
+func (p *workerPool) run(id int) error {
+	defer p.senders.Done()
+
+	var idleCh <-chan time.Time
+	var idleTimer *time.Timer
+	if p.min < p.max {
+		idleTimer = time.NewTimer(p.idleTimeout)
+		defer idleTimer.Stop()
+		idleCh = idleTimer.C
+	}
+
+	var reqs []*Request
+	var replies []*Reply
+	var next *Request
+	for {
+		req := next
+		next = nil
+		if req == nil {
+			p.idle.Add(1)
+			select {
+			case <-p.ctx.Done():
+				p.idle.Add(-1)
+				p.exit()
+				return p.ctx.Err()
+			case req = <-p.reqCh:
+			case <-idleCh:
+				if p.retire() {
+					p.idle.Add(-1)
+					return nil
+				}
+				idleTimer.Reset(p.idleTimeout)
+				p.idle.Add(-1)
+				continue
+			}
+			p.idle.Add(-1)
+			if req == nil {
+				p.exit()
+				return nil
+			}
+		}
+
+		reqs = append(reqs[:0], req)
+		if p.s.opts.MaxCoalesceBytes > 0 {
+			reqs, next = p.gatherWrites(reqs)
+		}
+		var err error
+		replies, err = p.perform(id, reqs, replies[:0])
+		if err != nil {
+			if next != nil {
+				p.s.reqPool.Put(next)
+			}
+			p.exit()
+			return err
+		}
+
+		if idleTimer != nil {
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			idleTimer.Reset(p.idleTimeout)
+		}
+	}
+}
+
+// gatherWrites appends queued writes which directly follow the write in reqs
+// to it, up to MaxCoalesceBytes. The first queued request which can't be
+// merged is returned, and must be performed next. When requests are ordered,
+// writes which must wait for earlier requests aren't merged, since those may
+// in turn be waiting for the writes already gathered.
+func (p *workerPool) gatherWrites(reqs []*Request) ([]*Request, *Request) {
+	first := reqs[0]
+	if !first.canCoalesce() {
+		return reqs, nil
+	}
+	total := int(first.length)
+	end := first.offset + uint64(first.length)
+	for {
+		select {
+		case r := <-p.reqCh:
+			if r == nil {
+				return reqs, nil
+			}
+			if !r.canCoalesce() || r.offset != end || total+int(r.length) > p.s.opts.MaxCoalesceBytes || !r.mayPerform() {
+				return reqs, r
+			}
+			reqs = append(reqs, r)
+			total += int(r.length)
+			end += uint64(r.length)
+		default:
+			return reqs, nil
+		}
+	}
+}
+
+// perform does reqs, which are either a single request or adjacent writes,
+// on worker id, and queues their replies. replies is used as scratch space,
+// and returned for reuse.
+func (p *workerPool) perform(id int, reqs []*Request, replies []*Reply) ([]*Reply, error) {
+	for _, req := range reqs {
+		if ch := req.waitChan(); ch != nil {
+			select {
+			case <-ch:
+			case <-p.ctx.Done():
+				for _, r := range reqs {
+					p.s.reqPool.Put(r)
+				}
+				return replies, p.ctx.Err()
+			}
+		}
+	}
+
+	for _, req := range reqs {
+		p.s.observeDispatched(req)
+		p.s.inFlight.dispatched(req, id)
+	}
+
+	start := time.Now()
+	if len(reqs) == 1 {
+		replies = append(replies, p.s.doRequest(reqs[0]))
+	} else {
+		replies = p.s.doWrites(reqs, replies)
+	}
+	p.recordLatency(time.Since(start))
+
+	for _, req := range reqs {
+		p.s.ranges.release(req)
+		p.s.reqPool.Put(req)
+	}
+	for i, reply := range replies {
+		select {
+		case p.replyCh <- reply:
+		case <-p.ctx.Done():
+			for _, r := range replies[i:] {
+				p.s.replyPool.Put(r)
+			}
+			return replies, p.ctx.Err()
+		}
+	}
+	return replies, nil
+}
+
+func (p *workerPool) exit() {
+	p.lock.Lock()
+	p.count--
+	p.s.numWorkers.Add(-1)
+	p.s.workerBudget.release()
+	p.lock.Unlock()
+}
+
+// workerBudget limits the total number of workers of the devices of a
+// Manager. A nil workerBudget is unlimited.
+type workerBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// acquire reserves a worker, and returns false if the budget has been used
+// up. If force is true, the worker is reserved even if that exceeds the
+// budget.
+func (b *workerBudget) acquire(force bool) bool {
+	if b == nil {
+		return true
+	}
+	if b.used.Add(1) > b.limit && !force {
+		b.used.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (b *workerBudget) release() {
+	if b == nil {
+		return
+	}
+	b.used.Add(-1)
+}
@@ -0,0 +1,197 @@
+package nbd
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowDevice is a memDevice with slow reads, which records how many are
+// performed concurrently.
+type slowDevice struct {
+	*memDevice
+	delay time.Duration
+
+	active    atomic.Int32
+	maxActive atomic.Int32
+}
+
+func (d *slowDevice) ReadAt(b []byte, off int64) (int, error) {
+	n := d.active.Add(1)
+	defer d.active.Add(-1)
+	for {
+		m := d.maxActive.Load()
+		if n <= m || d.maxActive.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(d.delay)
+	return d.memDevice.ReadAt(b, off)
+}
+
+// waitFor polls cond until it is true, and fails the test if it doesn't
+// become true in time.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdaptiveWorkers(t *testing.T) {
+	const n = 32
+	dev := &slowDevice{memDevice: newMemDevice(1 << 20), delay: 10 * time.Millisecond}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{
+		ConcurrentOps:     8,
+		MinConcurrentOps:  1,
+		WorkerIdleTimeout: 20 * time.Millisecond,
+	})
+	c := startServer(t, s, k)
+
+	c.read(0, 0, 4096)
+	if w := s.Workers(); w != 1 {
+		t.Errorf("got %d workers after one request, want 1", w)
+	}
+
+	// Queued requests on a slow device add workers, up to ConcurrentOps.
+	for i := 0; i < n; i++ {
+		c.send(nbdCmdRead, uint64(i), uint64(i)*4096, 4096, nil)
+	}
+	for i := 0; i < n; i++ {
+		if code, _, _ := c.reply(4096); code != 0 {
+			t.Fatalf("read failed with %d", code)
+		}
+	}
+	if m := dev.maxActive.Load(); m <= 1 || m > 8 {
+		t.Errorf("performed up to %d reads concurrently, want between 2 and 8", m)
+	}
+
+	// Idle workers are removed, down to MinConcurrentOps.
+	waitFor(t, "idle workers to exit", func() bool { return s.Workers() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if w := s.Workers(); w != 1 {
+		t.Errorf("got %d workers while idle, want 1", w)
+	}
+
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if w := s.Workers(); w != 0 {
+		t.Errorf("got %d workers after stopping, want 0", w)
+	}
+}
+
+// writeLog is a memDevice which records the offset and length of each write.
+type writeLog struct {
+	*gatedDevice
+	lock   sync.Mutex
+	writes [][2]int64
+}
+
+func (d *writeLog) WriteAt(b []byte, off int64) (int, error) {
+	d.lock.Lock()
+	d.writes = append(d.writes, [2]int64{off, int64(len(b))})
+	d.lock.Unlock()
+	return d.gatedDevice.WriteAt(b, off)
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	const workers = 4
+	dev := &writeLog{gatedDevice: newGatedDevice(1 << 20)}
+	s, k := newTestServer(t, dev, 1<<20, BlockDeviceOptions{ConcurrentOps: workers, MaxCoalesceBytes: 12288})
+	c := startServer(t, s, k)
+
+	// Queue adjacent writes while every worker is busy.
+	for i := 0; i < workers; i++ {
+		c.send(nbdCmdWrite, uint64(100+i), uint64(i+1)*65536, 4096, pattern(4096, 0))
+		dev.expectStart(t, int64(i+1)*65536)
+	}
+	data := pattern(workers*4096, 1)
+	for i := 0; i < workers; i++ {
+		off := i * 4096
+		c.send(nbdCmdWrite, uint64(i), uint64(off), 4096, data[off:off+4096])
+	}
+	waitFor(t, "writes to be queued", func() bool { return s.Stats().QueueDepth == workers })
+
+	// The writes are merged up to MaxCoalesceBytes.
+	dev.release(t, 65536)
+	dev.expectStart(t, 0)
+	dev.release(t, 0)
+	dev.expectStart(t, 12288)
+	dev.release(t, 12288)
+	for i := 1; i < workers; i++ {
+		dev.release(t, int64(i+1)*65536)
+	}
+	for i := 0; i < 2*workers; i++ {
+		if code, h, _ := c.reply(0); code != 0 {
+			t.Errorf("got error %d for handle %d", code, h)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	var got [][2]int64
+	for _, w := range dev.writes {
+		if w[0] < 65536 {
+			got = append(got, w)
+		}
+	}
+	want := [][2]int64{{0, 12288}, {12288, 4096}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got writes %v, want %v", got, want)
+	}
+	if string(dev.data[:len(data)]) != string(data) {
+		t.Error("coalesced writes wrote the wrong data")
+	}
+}
+
+func TestCoalesceWritesWithFlushBarrier(t *testing.T) {
+	dev := newGatedDevice(4 << 20)
+	s, k := newTestServer(t, dev, 4<<20, BlockDeviceOptions{ConcurrentOps: 2, FlushBarrier: true, MaxCoalesceBytes: 1 << 20})
+	c := startServer(t, s, k)
+
+	c.send(nbdCmdWrite, 1, 1<<20, 4096, pattern(4096, 1))
+	dev.expectStart(t, 1<<20)
+	c.send(nbdCmdWrite, 2, 2<<20, 4096, pattern(4096, 2))
+	dev.expectStart(t, 2<<20)
+	c.send(nbdCmdWrite, 3, 3<<20, 4096, pattern(4096, 3))
+	c.send(nbdCmdWrite, 4, 0, 4096, pattern(4096, 4))
+	c.send(nbdCmdFlush, 5, 0, 0, nil)
+	c.send(nbdCmdWrite, 6, 4096, 4096, pattern(4096, 6))
+	waitFor(t, "requests to be queued", func() bool { return s.Stats().QueueDepth == 2 })
+
+	// The first worker performs the write at 3M, holding the write at 0 as
+	// the next request, since it can't be merged.
+	dev.release(t, 1<<20)
+	dev.expectStart(t, 3<<20)
+	// The second worker takes the flush, which waits for the write at 0.
+	dev.release(t, 2<<20)
+	waitFor(t, "the flush to be taken", func() bool {
+		// Once the first two writes have completed, and the rest have been
+		// received, only the write at 4096 is left in the queue.
+		st := s.Stats()
+		return st.Ops[CmdWrite].Requests == 2 && st.InFlight == 4 && st.QueueDepth == 1
+	})
+
+	// The write at 4096 is adjacent to the write at 0, but mustn't be merged
+	// with it, since it waits for the flush.
+	dev.release(t, 3<<20)
+	for _, off := range []int64{0, -1, 4096} {
+		dev.expectStart(t, off)
+		dev.release(t, off)
+	}
+	for i := 0; i < 6; i++ {
+		if code, h, _ := c.reply(0); code != 0 {
+			t.Errorf("got error %d for handle %d", code, h)
+		}
+	}
+	if err := c.stop(); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}